@@ -1,7 +1,12 @@
 package main
 
 import (
+	"container/list"
+	"context"
+	"encoding/binary"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -22,94 +27,906 @@ const (
 type Translator interface {
 	TranslateOutUDP(packet []byte) TranslatorVerdict
 	TranslateInUDP(packet []byte) TranslatorVerdict
+	TranslateOutTCP(packet []byte) TranslatorVerdict
+	TranslateInTCP(packet []byte) TranslatorVerdict
+	TranslateOutICMP(packet []byte) TranslatorVerdict
+	TranslateInICMP(packet []byte) TranslatorVerdict
+	// Reap deletes all mappings that have expired as of now.
+	Reap(now time.Time)
+	// Mappings returns a snapshot of the live mappings that match f,
+	// oldest first.
+	Mappings(f MappingFilter) []Mapping
+	// DeleteMappings deletes the mappings that match f, and returns
+	// snapshots of them.
+	DeleteMappings(f MappingFilter) []Mapping
+	// SetConfig replaces the translator's policy.
+	SetConfig(cfg *TranslatorConfig)
+	// Metrics returns the translator's counters.
+	Metrics() *Metrics
 }
 
+// TranslatorConfig holds the policy knobs of a Translator.
+type TranslatorConfig struct {
+	// How does the destination of an outbound packet influence the
+	// reuse of an existing mapping? (REQ-1)
+	Mapping MappingBehavior
+	// What inbound packets may traverse an existing mapping? (REQ-8)
+	Filtering FilteringBehavior
+	// Can LAN clients reach each other through their mapped
+	// addresses? (REQ-9)
+	Hairpinning HairpinBehavior
+	// How long can a mapping go without seeing qualifying traffic
+	// before it gets deleted? (REQ-5)
+	MappingTimeout time.Duration
+	// Overrides of MappingTimeout for UDP traffic with specific remote
+	// ports. The first matching entry wins.
+	PortTimeouts []PortTimeout
+	// Idle timeouts for TCP mappings with at least one established
+	// connection, and for those with only connections that are
+	// opening or closing (RFC 5382, REQ-5).
+	TCPEstablishedTimeout time.Duration
+	TCPTransitoryTimeout  time.Duration
+	// Idle timeout for ICMP echo mappings.
+	ICMPTimeout time.Duration
+	// What packets qualify for refreshing a mapping? (REQ-6)
+	Refresh RefreshBehavior
+	// Are ICMP errors pertaining to mapped sessions translated and
+	// forwarded, rather than dropped? (REQ-12)
+	TranslateICMP bool
+	// Zero out the UDP and TCP checksums of translated packets,
+	// rather than updating them. This emulates broken NATs.
+	ZeroChecksums bool
+	// Maximum number of mappings that a single LAN IP can hold, or
+	// zero for no limit. QuotaOverflow determines what happens when
+	// a LAN IP at its quota tries to create a new mapping.
+	HostQuota     int
+	QuotaOverflow OverflowBehavior
+	// Maximum number of mappings in the whole NAT table, or zero for
+	// no limit. TableOverflow determines what happens when a new
+	// mapping is needed and the table is full.
+	MaxMappings   int
+	TableOverflow OverflowBehavior
+}
+
+// ctKey is the lookup key for outbound packets. Depending on the
+// mapping behavior, some or all of Dst is zeroed out.
+type ctKey struct {
+	Proto byte
+	Src   Addr
+	Dst   Addr
+}
+
+// mappedKey is the lookup key for inbound packets.
+type mappedKey struct {
+	Proto byte
+	Addr  Addr
+}
+
+// ctEntry is a mapping. Its Proto, Original, Mapped, Close and
+// Created fields never change, and may be read without locking. The
+// rest is guarded by the lock of the mapping's hostShard.
 type ctEntry struct {
-	Original UDPAddr
-	Mapped   UDPAddr
+	Proto byte
+	// Original and Mapped are the LAN and WAN ip:ports of the
+	// mapping. For ICMP echo mappings, the port is the echo
+	// identifier.
+	Original Addr
+	Mapped   Addr
 	Close    func()
+	Created  time.Time
+	// LastUsed is when a packet last went through the mapping, in
+	// either direction.
+	LastUsed time.Time
 	Deadline time.Time
+	// Timeout is the refresh timer that was last applied to the
+	// mapping.
+	Timeout time.Duration
+	// Remotes is the set of WAN endpoints that Original has sent
+	// packets to through this mapping.
+	Remotes map[Addr]bool
+	// TCP tracks the connections going through a TCP mapping, keyed
+	// by remote address. It is nil for other protocols.
+	TCP map[Addr]*tcpConn
+	// Packets and bytes that went through the mapping in each
+	// direction.
+	PacketsOut, PacketsIn uint64
+	BytesOut, BytesIn     uint64
+
+	key ctKey
+	// byCreation and byUse are the mapping's elements in its
+	// hostShard's age lists.
+	byCreation, byUse *list.Element
+}
+
+func (e *ctEntry) mappedKey() mappedKey {
+	return mappedKey{Proto: e.Proto, Addr: e.Mapped}
+}
+
+// used records the passage of p through ct, whose hostShard h must
+// be locked.
+func (h *hostShard) used(ct *ctEntry, p *Packet, outbound bool) {
+	ct.LastUsed = time.Now()
+	if outbound {
+		ct.PacketsOut++
+		ct.BytesOut += uint64(len(p.bytes))
+	} else {
+		ct.PacketsIn++
+		ct.BytesIn += uint64(len(p.bytes))
+	}
+	h.byUse.MoveToBack(ct.byUse)
 }
 
-func (e *ctEntry) expired() bool {
-	return e.Deadline.Before(time.Now())
+func (e *ctEntry) expired(now time.Time) bool {
+	return e.Deadline.Before(now)
 }
 
-func (e *ctEntry) extend() {
-	e.Deadline = time.Now().Add(120 * time.Second)
+func (e *ctEntry) extend(timeout time.Duration) {
+	e.Timeout = timeout
+	e.Deadline = time.Now().Add(timeout)
 }
 
-type endpointIndependentNAT struct {
-	publicIP net.IP
+// timeout returns the mapping timeout for ct, after exchanging
+// traffic with remote.
+func (c *TranslatorConfig) timeout(ct *ctEntry, remote Addr) time.Duration {
+	switch ct.Proto {
+	case protoTCP:
+		if ct.tcpEstablished() {
+			return c.TCPEstablishedTimeout
+		}
+		return c.TCPTransitoryTimeout
+	case protoICMP:
+		return c.ICMPTimeout
+	}
+	for _, t := range c.PortTimeouts {
+		if t.Ports.Contains(remote.Port) {
+			return t.Timeout
+		}
+	}
+	return c.MappingTimeout
+}
+
+// numShards is the number of stripes that the NAT table is split
+// into. Packets for mappings in different stripes can be translated
+// in parallel.
+const numShards = 64
+
+// hostShard holds the mappings of the LAN IPs that hash to it. Its
+// lock also guards the mutable state of those mappings.
+type hostShard struct {
+	mu sync.Mutex
 	// byOriginal matches on outbound packet 4-tuples.
-	byOriginal map[UDPAddr]*ctEntry
+	byOriginal map[ctKey]*ctEntry
+	// byHost groups the mappings of each LAN IP, to enforce HostQuota.
+	byHost map[[4]byte]map[ctKey]*ctEntry
+	// byCreation and byUse hold the shard's *ctEntry values, oldest
+	// and least recently used first, so that TableOverflow can find
+	// its victim without scanning the table.
+	byCreation list.List
+	byUse      list.List
+}
+
+// mappedShard indexes the mappings whose WAN ip:ports hash to it.
+type mappedShard struct {
+	mu sync.Mutex
 	// byMapped matches on inbound packet 4-tuples
-	byMapped    map[UDPAddr]*ctEntry
+	byMapped map[mappedKey]*ctEntry
+}
+
+// natTranslator is a Translator that is safe for concurrent use.
+//
+// A goroutine holds at most one hostShard lock and one mappedShard
+// lock at a time. Locks are taken in this order: allocMu, hostShard,
+// mappedShard, then the PortManager's own lock.
+type natTranslator struct {
+	// config holds the current *TranslatorConfig, which SetConfig
+	// can swap out while packets are being translated.
+	config      atomic.Value
+	wanIPs      map[[4]byte]bool
+	hosts       [numShards]hostShard
+	mapped      [numShards]mappedShard
 	portManager *portmanager.PortManager
+	metrics     *Metrics
+	// allocMu serializes the creation of mappings, so that a WAN port
+	// and its entry in byMapped change owners together, evicted finds
+	// the right previous owner, and the table never grows past
+	// MaxMappings.
+	allocMu sync.Mutex
+
+	// evictions are the mappings that lost their WAN port to port
+	// overloading, and are waiting to be deleted.
+	evictMu   sync.Mutex
+	evictions []*ctEntry
 }
 
-func NewAddressAndPortDependentNAT(wanIPs []net.IP) Translator {
-	cfg := &portmanager.Config{
-		WANIPs: wanIPs,
+// NewTranslator returns a Translator that implements the given
+// policies, and allocates WAN ports according to ports.
+func NewTranslator(cfg *TranslatorConfig, ports *portmanager.Config) Translator {
+	wanIPs := map[[4]byte]bool{}
+	for _, ip := range ports.WANIPs {
+		var k [4]byte
+		copy(k[:], ip.To4())
+		wanIPs[k] = true
 	}
 
-	return &endpointIndependentNAT{
-		byOriginal:  map[UDPAddr]*ctEntry{},
-		byMapped:    map[UDPAddr]*ctEntry{},
-		portManager: portmanager.New(cfg),
+	ret := &natTranslator{
+		wanIPs:      wanIPs,
+		portManager: portmanager.New(ports),
+		metrics:     newMetrics(ports.WANIPs),
 	}
+	ret.config.Store(cfg)
+	for i := range ret.hosts {
+		ret.hosts[i].byOriginal = map[ctKey]*ctEntry{}
+		ret.hosts[i].byHost = map[[4]byte]map[ctKey]*ctEntry{}
+		ret.mapped[i].byMapped = map[mappedKey]*ctEntry{}
+	}
+	ret.portManager.SetEvictHandler(ret.evicted)
+	return ret
+}
+
+// cfg returns the translator's current policy.
+func (n *natTranslator) cfg() *TranslatorConfig {
+	return n.config.Load().(*TranslatorConfig)
+}
+
+// SetConfig replaces the translator's policy. Existing mappings keep
+// their current deadlines. Lowered quotas and capacity are enforced
+// the next time a mapping is created, in the table or by the LAN host
+// at hand, by evicting as many mappings as it takes to get back under
+// the new limit.
+//
+// cfg.Mapping must not change, since the NAT table is keyed by it.
+func (n *natTranslator) SetConfig(cfg *TranslatorConfig) {
+	n.config.Store(cfg)
+}
+
+func (n *natTranslator) Metrics() *Metrics {
+	return n.metrics
+}
+
+// hostShard returns the shard that holds the mappings of the LAN IP
+// host.
+func (n *natTranslator) hostShard(host [4]byte) *hostShard {
+	return &n.hosts[binary.BigEndian.Uint32(host[:])%numShards]
+}
+
+// mappedShard returns the shard that indexes the mapping for k.
+func (n *natTranslator) mappedShard(k mappedKey) *mappedShard {
+	h := binary.BigEndian.Uint32(k.Addr.IPv4[:]) + uint32(k.Addr.Port)
+	return &n.mapped[h%numShards]
+}
+
+// lookupMapped returns the mapping for k, if any. The caller must
+// lock the mapping with lockMapping before using it.
+func (n *natTranslator) lookupMapped(k mappedKey) *ctEntry {
+	m := n.mappedShard(k)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.byMapped[k]
+}
+
+// lockMapping locks and returns the hostShard of ct, which was found
+// with lookupMapped. It returns nil if ct has since been deleted, or
+// has expired.
+func (n *natTranslator) lockMapping(ct *ctEntry) *hostShard {
+	h := n.hostShard(ct.Original.IPv4)
+	h.mu.Lock()
+	if h.byOriginal[ct.key] != ct {
+		h.mu.Unlock()
+		return nil
+	}
+	if ct.expired(time.Now()) {
+		n.expire(h, ct)
+		h.mu.Unlock()
+		return nil
+	}
+	return h
+}
+
+// lookupOriginal returns the unexpired mapping for key in h, if
+// any. h must be locked.
+func (n *natTranslator) lookupOriginal(h *hostShard, key ctKey) *ctEntry {
+	ct := h.byOriginal[key]
+	if ct != nil && ct.expired(time.Now()) {
+		n.expire(h, ct)
+		return nil
+	}
+	return ct
+}
+
+func (n *natTranslator) TranslateOutUDP(bs []byte) TranslatorVerdict {
+	p := NewPacket(bs)
+	return n.fixChecksums(p, n.translateOut(p))
 }
 
-func (n endpointIndependentNAT) TranslateOutUDP(bs []byte) TranslatorVerdict {
+func (n *natTranslator) TranslateInUDP(bs []byte) TranslatorVerdict {
 	p := NewPacket(bs)
-	key := p.UDPSrcAddr()
+	return n.fixChecksums(p, n.translateIn(p))
+}
+
+func (n *natTranslator) TranslateOutTCP(bs []byte) TranslatorVerdict {
+	p := NewPacket(bs)
+	return n.fixChecksums(p, n.translateOut(p))
+}
+
+func (n *natTranslator) TranslateInTCP(bs []byte) TranslatorVerdict {
+	p := NewPacket(bs)
+	return n.fixChecksums(p, n.translateIn(p))
+}
+
+// fixChecksums applies the checksum policy to p, if verdict says
+// that p was mangled.
+func (n *natTranslator) fixChecksums(p *Packet, verdict TranslatorVerdict) TranslatorVerdict {
+	if verdict == TranslatorVerdictMangle && n.cfg().ZeroChecksums {
+		p.ZeroL4Checksum()
+	}
+	return verdict
+}
+
+// translateOut translates a UDP, TCP or ICMP echo request packet
+// from the LAN.
+func (n *natTranslator) translateOut(p *Packet) TranslatorVerdict {
+	cfg := n.cfg()
+	proto := p.l4proto()
+	remote := p.DstAddr()
+	hairpin := n.wanIPs[remote.IPv4]
+	if proto == protoICMP {
+		if hairpin {
+			// Pinging the NAT box itself.
+			return TranslatorVerdictAccept
+		}
+		// The echo identifier stands in for the port on both ends,
+		// but it's really only a property of the LAN end.
+		remote.Port = 0
+	}
+	if hairpin && cfg.Hairpinning == HairpinNone {
+		return n.metrics.drop(dropHairpinDisabled)
+	}
+	key := cfg.Mapping.key(proto, p.SrcAddr(), remote)
+	mapped, ok := n.mapOut(p, key, remote)
+	if !ok {
+		return TranslatorVerdictDrop
+	}
+	if hairpin {
+		return n.hairpin(p, mapped)
+	}
+	p.SetSrcAddr(mapped)
+
+	return TranslatorVerdictMangle
+}
+
+// createsMapping reports whether the outbound packet p may create a
+// new mapping.
+func createsMapping(p *Packet) bool {
+	// Only connection attempts may create TCP mappings.
+	return p.l4proto() != protoTCP || p.tcpFlags()&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN
+}
+
+// mapOut finds or creates the mapping for key, records the passage
+// of the outbound packet p to remote, and returns the mapped
+// address. If it returns false, it has already counted the drop of p.
+func (n *natTranslator) mapOut(p *Packet, key ctKey, remote Addr) (mapped Addr, ok bool) {
+	// Deferred first, so that it runs after h is unlocked.
+	defer n.processEvictions()
 
-	ct := n.byOriginal[key]
-	if ct != nil && ct.expired() {
-		n.deleteMapping(ct)
-		ct = nil
+	cfg := n.cfg()
+	h := n.hostShard(key.Src.IPv4)
+	h.mu.Lock()
+	ct := n.lookupOriginal(h, key)
+	if ct == nil && createsMapping(p) {
+		// Mappings are only created under allocMu, which must be taken
+		// before h.
+		h.mu.Unlock()
+		n.allocMu.Lock()
+		defer n.allocMu.Unlock()
+		if !n.enforceCapacity(key) {
+			n.metrics.drop(dropTableFull)
+			return Addr{}, false
+		}
+		h.mu.Lock()
+		ct = n.lookupOriginal(h, key)
 	}
+	defer h.mu.Unlock()
+
+	created := false
 	if ct == nil {
-		mappedAddr, close, err := n.portManager.AllocateUDP(p.UDPSrcAddr().ToNetUDPAddr())
-		if err != nil {
-			log.Errorf("Failed to park port: %s", err)
-			return TranslatorVerdictDrop
+		if !createsMapping(p) {
+			n.metrics.drop(dropNoMapping)
+			return Addr{}, false
+		}
+		if !n.enforceQuota(h, key.Src.IPv4) {
+			n.metrics.drop(dropQuota)
+			return Addr{}, false
+		}
+		if ct = n.newMapping(h, key, remote); ct == nil {
+			n.metrics.drop(dropAllocationFailure)
+			return Addr{}, false
+		}
+		created = true
+	}
+
+	ct.Remotes[remote] = true
+	h.used(ct, p, true)
+	if key.Proto == protoTCP {
+		ct.trackTCP(remote, p.tcpFlags(), true)
+	}
+	if created || cfg.Refresh.outbound() {
+		ct.extend(cfg.timeout(ct, remote))
+	}
+	return ct.Mapped, true
+}
+
+// exists reports whether there is a mapping for key.
+func (n *natTranslator) exists(key ctKey) bool {
+	h := n.hostShard(key.Src.IPv4)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return n.lookupOriginal(h, key) != nil
+}
+
+// newMapping allocates a WAN ip:port for key and records the new
+// mapping in h, which must be locked. n.allocMu must be held. It
+// returns nil if no WAN port is available.
+func (n *natTranslator) newMapping(h *hostShard, key ctKey, remote Addr) *ctEntry {
+	var (
+		mapped Addr
+		close  func()
+		err    error
+	)
+	switch key.Proto {
+	case protoUDP:
+		var addr *net.UDPAddr
+		if addr, close, err = n.portManager.AllocateUDP(key.Src.ToNetUDPAddr(), remote.ToNetUDPAddr()); err == nil {
+			mapped = FromNetUDPAddr(addr)
+		}
+	case protoTCP:
+		var addr *net.TCPAddr
+		if addr, close, err = n.portManager.AllocateTCP(key.Src.ToNetTCPAddr(), remote.ToNetTCPAddr()); err == nil {
+			mapped = FromNetTCPAddr(addr)
+		}
+	case protoICMP:
+		var (
+			ip net.IP
+			id int
+		)
+		if ip, id, close, err = n.portManager.AllocateICMP(key.Src.ToNetUDPAddr().IP, int(key.Src.Port), remote.ToNetUDPAddr().IP); err == nil {
+			copy(mapped.IPv4[:], ip.To4())
+			mapped.Port = uint16(id)
+		}
+	default:
+		panic("unimplemented case")
+	}
+	if err != nil {
+		log.Errorf("Failed to park port: %s", err)
+		return nil
+	}
+
+	now := time.Now()
+	ct := &ctEntry{
+		Proto:    key.Proto,
+		Original: key.Src,
+		Mapped:   mapped,
+		Close:    close,
+		Created:  now,
+		LastUsed: now,
+		Remotes:  map[Addr]bool{},
+		key:      key,
+	}
+	if key.Proto == protoTCP {
+		ct.TCP = map[Addr]*tcpConn{}
+	}
+	h.byOriginal[ct.key] = ct
+	host := h.byHost[key.Src.IPv4]
+	if host == nil {
+		host = map[ctKey]*ctEntry{}
+		h.byHost[key.Src.IPv4] = host
+	}
+	host[ct.key] = ct
+
+	m := n.mappedShard(ct.mappedKey())
+	m.mu.Lock()
+	m.byMapped[ct.mappedKey()] = ct
+	m.mu.Unlock()
+	ct.byCreation = h.byCreation.PushBack(ct)
+	ct.byUse = h.byUse.PushBack(ct)
+
+	atomic.AddInt64(&n.metrics.mappings, 1)
+	n.metrics.allocated(mapped.IPv4)
+	return ct
+}
+
+// enforceQuota makes room in h, which must be locked, for a new
+// mapping from the LAN IP host, if host is at its HostQuota. It
+// returns false if the new mapping must not be created.
+func (n *natTranslator) enforceQuota(h *hostShard, host [4]byte) bool {
+	cfg := n.cfg()
+	if cfg.HostQuota == 0 {
+		return true
+	}
+	now := time.Now()
+	for _, ct := range h.byHost[host] {
+		if ct.expired(now) {
+			n.expire(h, ct)
+		}
+	}
+	if len(h.byHost[host]) < cfg.HostQuota {
+		return true
+	}
+
+	// If the quota was lowered, host may be more than one mapping
+	// over it.
+	hits := atomic.AddUint64(&n.metrics.quotaHits, 1)
+	for len(h.byHost[host]) >= cfg.HostQuota {
+		ct := cfg.QuotaOverflow.victim(h.byHost[host])
+		if ct == nil {
+			log.Infof("LAN host %s is at its quota of %d mappings, dropping new flow (%d quota hits)", net.IP(host[:]), cfg.HostQuota, hits)
+			return false
+		}
+		log.Infof("Mapping %s <> %s evicted by LAN host quota (%d quota hits)", ct.Original, ct.Mapped, hits)
+		n.deleteMapping(h, ct)
+	}
+	return true
+}
+
+// full reports whether the NAT table holds MaxMappings mappings.
+func (n *natTranslator) full() bool {
+	cfg := n.cfg()
+	return cfg.MaxMappings > 0 && atomic.LoadInt64(&n.metrics.mappings) >= int64(cfg.MaxMappings)
+}
+
+// enforceCapacity makes room for a new mapping for key, if the NAT
+// table is full. It returns false if the new mapping must not be
+// created. n.allocMu must be held, and no shard locked.
+//
+// Expired mappings count against MaxMappings until the reaper
+// deletes them.
+func (n *natTranslator) enforceCapacity(key ctKey) bool {
+	cfg := n.cfg()
+	if !n.full() || n.exists(key) {
+		return true
+	}
+
+	// If MaxMappings was lowered, the table may be more than one
+	// mapping over it.
+	hits := atomic.AddUint64(&n.metrics.tableFullHits, 1)
+	for n.full() {
+		ct := n.tableVictim(cfg.TableOverflow)
+		if ct == nil {
+			log.Infof("NAT table is full with %d mappings, dropping new flow (%d table full hits)", atomic.LoadInt64(&n.metrics.mappings), hits)
+			return false
 		}
+		// If the victim was deleted since it was picked, that made
+		// room just as well.
+		h := n.hostShard(ct.Original.IPv4)
+		h.mu.Lock()
+		if h.byOriginal[ct.key] == ct {
+			log.Infof("Mapping %s <> %s evicted from full NAT table (%d table full hits)", ct.Original, ct.Mapped, hits)
+			n.deleteMapping(h, ct)
+		}
+		h.mu.Unlock()
+	}
+	return true
+}
 
-		ct = &ctEntry{
-			Original: key,
-			Mapped:   FromNetUDPAddr(mappedAddr),
-			Close:    close,
+// tableVictim returns the mapping that o evicts from a full NAT
+// table, or nil if o refuses new mappings instead. No shard may be
+// locked by the caller.
+//
+// Each shard orders its own mappings, so the victim is the oldest or
+// least recently used of the shards' front runners.
+func (n *natTranslator) tableVictim(o OverflowBehavior) *ctEntry {
+	if o == OverflowDrop {
+		return nil
+	}
+	var (
+		ret *ctEntry
+		age time.Time
+	)
+	for i := range n.hosts {
+		h := &n.hosts[i]
+		h.mu.Lock()
+		switch o {
+		case OverflowEvictOldest:
+			if e := h.byCreation.Front(); e != nil {
+				if ct := e.Value.(*ctEntry); ret == nil || ct.Created.Before(age) {
+					ret, age = ct, ct.Created
+				}
+			}
+		case OverflowEvictLRU:
+			if e := h.byUse.Front(); e != nil {
+				if ct := e.Value.(*ctEntry); ret == nil || ct.LastUsed.Before(age) {
+					ret, age = ct, ct.LastUsed
+				}
+			}
+		default:
+			panic("unimplemented case")
 		}
-		ct.extend()
-		n.byOriginal[ct.Original] = ct
-		n.byMapped[ct.Mapped] = ct
+		h.mu.Unlock()
 	}
+	return ret
+}
 
-	p.SetUDPSrcAddr(ct.Mapped)
+// hairpin delivers p, which the mapping with WAN address src sent to
+// one of our own mapped addresses, back onto the LAN.
+func (n *natTranslator) hairpin(p *Packet, src Addr) TranslatorVerdict {
+	cfg := n.cfg()
+	ct := n.lookupMapped(mappedKey{Proto: p.l4proto(), Addr: p.DstAddr()})
+	if ct == nil {
+		return n.metrics.drop(dropNoMapping)
+	}
+	h := n.lockMapping(ct)
+	if h == nil {
+		return n.metrics.drop(dropExpired)
+	}
+	defer h.mu.Unlock()
 
+	// From the destination mapping's point of view, the packet is
+	// arriving from the sender's mapped address, regardless of what
+	// source address ends up on the delivered packet.
+	if !cfg.Filtering.allows(ct, src) {
+		return n.metrics.drop(dropFiltered)
+	}
+	h.used(ct, p, false)
+	if ct.Proto == protoTCP {
+		ct.trackTCP(src, p.tcpFlags(), false)
+	}
+	if cfg.Refresh.inbound() {
+		ct.extend(cfg.timeout(ct, src))
+	}
+
+	if cfg.Hairpinning == HairpinExternalSource {
+		p.SetSrcAddr(src)
+	}
+	p.SetDstAddr(ct.Original)
 	return TranslatorVerdictMangle
 }
 
-func (n endpointIndependentNAT) TranslateInUDP(bs []byte) TranslatorVerdict {
-	p := NewPacket(bs)
-	key := p.UDPDstAddr()
+// translateIn translates a UDP, TCP or ICMP echo reply packet from
+// the WAN.
+func (n *natTranslator) translateIn(p *Packet) TranslatorVerdict {
+	cfg := n.cfg()
+	key := mappedKey{Proto: p.l4proto(), Addr: p.DstAddr()}
+	remote := p.SrcAddr()
+	if key.Proto == protoICMP {
+		remote.Port = 0
+	}
 
-	ct := n.byMapped[key]
+	ct := n.lookupMapped(key)
 	if ct == nil {
-		return TranslatorVerdictDrop
+		return n.metrics.drop(dropNoMapping)
 	}
-	if ct.expired() {
-		n.deleteMapping(ct)
-		return TranslatorVerdictDrop
+	h := n.lockMapping(ct)
+	if h == nil {
+		return n.metrics.drop(dropExpired)
+	}
+	defer h.mu.Unlock()
+
+	if !cfg.Filtering.allows(ct, remote) {
+		return n.metrics.drop(dropFiltered)
+	}
+	h.used(ct, p, false)
+	if ct.Proto == protoTCP {
+		ct.trackTCP(remote, p.tcpFlags(), false)
+	}
+	if cfg.Refresh.inbound() {
+		ct.extend(cfg.timeout(ct, remote))
+	}
+	p.SetDstAddr(ct.Original)
+	return TranslatorVerdictMangle
+}
+
+// TranslateOutICMP translates an ICMP echo request, or an ICMP error
+// sent by a LAN client in response to a packet it received through a
+// mapping.
+func (n *natTranslator) TranslateOutICMP(bs []byte) TranslatorVerdict {
+	cfg := n.cfg()
+	p := NewPacket(bs)
+	if p.isICMP4Echo() {
+		if p.icmpType() != icmpEchoRequest {
+			return n.metrics.drop(dropUnsupported)
+		}
+		return n.translateOut(p)
+	}
+
+	if !cfg.TranslateICMP {
+		return n.metrics.drop(dropICMPDisabled)
+	}
+
+	quote := p.ICMPQuote()
+	// The quoted packet is one that we translated inbound, so its
+	// destination is the LAN client.
+	key := cfg.Mapping.key(quote.l4proto(), quote.DstAddr(), quote.SrcAddr())
+
+	h := n.hostShard(key.Src.IPv4)
+	h.mu.Lock()
+	ct := n.lookupOriginal(h, key)
+	h.mu.Unlock()
+	// Only the LAN client that owns the mapping gets to report errors
+	// about it.
+	if ct == nil || p.SrcIP() != ct.Original.IPv4 {
+		return n.metrics.drop(dropNoMapping)
 	}
-	ct.extend()
-	p.SetUDPDstAddr(ct.Original)
+
+	// ICMP errors don't refresh mappings (RFC 5508, REQ-11).
+	quote.SetDstAddr(ct.Mapped)
+	p.FixICMPChecksum()
+	p.SetSrcIP(ct.Mapped.IPv4)
+	return TranslatorVerdictMangle
+}
+
+// TranslateInICMP translates an ICMP echo reply, or an ICMP error
+// sent from the WAN in response to a packet that went out through a
+// mapping.
+func (n *natTranslator) TranslateInICMP(bs []byte) TranslatorVerdict {
+	p := NewPacket(bs)
+	if p.isICMP4Echo() {
+		if p.icmpType() != icmpEchoReply {
+			return n.metrics.drop(dropUnsupported)
+		}
+		return n.translateIn(p)
+	}
+
+	if !n.cfg().TranslateICMP {
+		return n.metrics.drop(dropICMPDisabled)
+	}
+
+	quote := p.ICMPQuote()
+	// The quoted packet is one that we translated outbound, so its
+	// source is our mapped address.
+	ct := n.lookupMapped(mappedKey{Proto: quote.l4proto(), Addr: quote.SrcAddr()})
+	if ct == nil || p.DstIP() != ct.Mapped.IPv4 {
+		return n.metrics.drop(dropNoMapping)
+	}
+	h := n.lockMapping(ct)
+	if h == nil {
+		return n.metrics.drop(dropExpired)
+	}
+	h.mu.Unlock()
+
+	quote.SetSrcAddr(ct.Original)
+	p.FixICMPChecksum()
+	p.SetDstIP(ct.Original.IPv4)
 	return TranslatorVerdictMangle
 }
 
-func (n endpointIndependentNAT) deleteMapping(ct *ctEntry) {
-	delete(n.byOriginal, ct.Original)
-	delete(n.byMapped, ct.Mapped)
+func (n *natTranslator) Reap(now time.Time) {
+	for i := range n.hosts {
+		h := &n.hosts[i]
+		h.mu.Lock()
+		for _, ct := range h.byOriginal {
+			if ct.expired(now) {
+				n.expire(h, ct)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (n *natTranslator) Mappings(f MappingFilter) []Mapping {
+	ret := []Mapping{}
+	now := time.Now()
+	for i := range n.hosts {
+		h := &n.hosts[i]
+		h.mu.Lock()
+		for _, ct := range h.byOriginal {
+			if !ct.expired(now) && f.matches(ct) {
+				ret = append(ret, ct.snapshot())
+			}
+		}
+		h.mu.Unlock()
+	}
+	sortMappings(ret)
+	return ret
+}
+
+func (n *natTranslator) DeleteMappings(f MappingFilter) []Mapping {
+	ret := []Mapping{}
+	for i := range n.hosts {
+		h := &n.hosts[i]
+		h.mu.Lock()
+		for _, ct := range h.byOriginal {
+			if f.matches(ct) {
+				log.Infof("Mapping %s <> %s deleted on request", ct.Original, ct.Mapped)
+				ret = append(ret, ct.snapshot())
+				n.deleteMapping(h, ct)
+			}
+		}
+		h.mu.Unlock()
+	}
+	sortMappings(ret)
+	return ret
+}
+
+// evicted handles the eviction of the mapping that owned a WAN port
+// which the port manager just handed over to a new mapping (REQ-3
+// Port-Overloading). It runs from within the allocation of the new
+// mapping, with the new mapping's hostShard locked, so it only queues
+// the evicted mapping for processEvictions.
+func (n *natTranslator) evicted(network string, ip net.IP, port int) {
+	key := mappedKey{Addr: Addr{Port: uint16(port)}}
+	copy(key.Addr.IPv4[:], ip.To4())
+	switch network {
+	case "udp4":
+		key.Proto = protoUDP
+	case "tcp4":
+		key.Proto = protoTCP
+	case "icmp4":
+		key.Proto = protoICMP
+	default:
+		panic("unimplemented case")
+	}
+
+	ct := n.lookupMapped(key)
+	if ct == nil {
+		return
+	}
+	n.evictMu.Lock()
+	defer n.evictMu.Unlock()
+	n.evictions = append(n.evictions, ct)
+}
+
+// processEvictions deletes the mappings queued by evicted. No shard
+// may be locked by the caller.
+func (n *natTranslator) processEvictions() {
+	n.evictMu.Lock()
+	cts := n.evictions
+	n.evictions = nil
+	n.evictMu.Unlock()
+
+	for _, ct := range cts {
+		h := n.hostShard(ct.Original.IPv4)
+		h.mu.Lock()
+		if h.byOriginal[ct.key] == ct {
+			log.Infof("Mapping %s <> %s evicted by port overloading", ct.Original, ct.Mapped)
+			n.deleteMapping(h, ct)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// expire deletes ct, which has outlived its deadline, from h, which
+// must be locked.
+func (n *natTranslator) expire(h *hostShard, ct *ctEntry) {
+	log.Infof("Mapping %s <> %s expired", ct.Original, ct.Mapped)
+	n.deleteMapping(h, ct)
+}
+
+// deleteMapping deletes ct from h, which must be locked, and from
+// the mapped index.
+func (n *natTranslator) deleteMapping(h *hostShard, ct *ctEntry) {
+	delete(h.byOriginal, ct.key)
+	if host := h.byHost[ct.Original.IPv4]; host != nil {
+		delete(host, ct.key)
+		if len(host) == 0 {
+			delete(h.byHost, ct.Original.IPv4)
+		}
+	}
+
+	// With port overloading, the mapped address may already belong
+	// to a newer mapping.
+	m := n.mappedShard(ct.mappedKey())
+	m.mu.Lock()
+	if m.byMapped[ct.mappedKey()] == ct {
+		delete(m.byMapped, ct.mappedKey())
+	}
+	m.mu.Unlock()
+	h.byCreation.Remove(ct.byCreation)
+	h.byUse.Remove(ct.byUse)
+
+	atomic.AddInt64(&n.metrics.mappings, -1)
+	n.metrics.released(ct.Mapped.IPv4)
 	ct.Close()
 }
+
+// runReaper calls t.Reap every interval, until ctx is canceled.
+func runReaper(ctx context.Context, t Translator, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.Reap(now)
+		}
+	}
+}
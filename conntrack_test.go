@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.universe.tf/natlab/portmanager"
+)
+
+var (
+	testWANIP = addr(203, 0, 113, 1, 0).IPv4
+	testLAN   = addr(192, 168, 1, 10, 5000)
+)
+
+// newTestTranslator returns a translator with a single WAN IP,
+// testWANIP, that tracks WAN ports in memory and picks them at
+// random. Timeouts left unset default to the flag defaults.
+func newTestTranslator(cfg TranslatorConfig) *natTranslator {
+	defaults := []struct {
+		timeout *time.Duration
+		value   time.Duration
+	}{
+		{&cfg.MappingTimeout, 2 * time.Minute},
+		{&cfg.TCPEstablishedTimeout, 124 * time.Minute},
+		{&cfg.TCPTransitoryTimeout, 4 * time.Minute},
+		{&cfg.ICMPTimeout, time.Minute},
+	}
+	for _, d := range defaults {
+		if *d.timeout == 0 {
+			*d.timeout = d.value
+		}
+	}
+	ports := &portmanager.Config{
+		WANIPs:       []net.IP{net.IP(testWANIP[:])},
+		PortMatching: portmanager.PortMatchingNone,
+		Seed:         1,
+	}
+	return NewTranslator(&cfg, ports).(*natTranslator)
+}
+
+// sendOut sends a UDP packet from src to dst through n, and returns
+// the translated source address. The test fails unless the packet is
+// translated.
+func sendOut(t *testing.T, n *natTranslator, src, dst Addr) Addr {
+	t.Helper()
+	bs := buildPacket(protoUDP, src, dst, []byte("ping"))
+	if v := n.TranslateOutUDP(bs); v != TranslatorVerdictMangle {
+		t.Fatalf("outbound %s -> %s got verdict %d, want mangle", src, dst, v)
+	}
+	p := NewPacket(bs)
+	if got := p.DstAddr(); got != dst {
+		t.Fatalf("outbound %s -> %s was redirected to %s", src, dst, got)
+	}
+	checkChecksums(t, bs)
+	return p.SrcAddr()
+}
+
+func TestMappingBehavior(t *testing.T) {
+	remote1 := addr(198, 51, 100, 7, 3478)
+	remote1OtherPort := addr(198, 51, 100, 7, 3479)
+	remote2 := addr(198, 51, 100, 8, 3478)
+
+	tests := []struct {
+		mapping MappingBehavior
+		// Whether the mapping for remote1 is reused for a different
+		// port on the same IP, and for a different IP.
+		samePortReused bool
+		otherIPReused  bool
+	}{
+		{MappingEndpointIndependent, true, true},
+		{MappingAddressDependent, true, false},
+		{MappingAddressAndPortDependent, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.mapping.String(), func(t *testing.T) {
+			n := newTestTranslator(TranslatorConfig{Mapping: test.mapping})
+
+			mapped := sendOut(t, n, testLAN, remote1)
+			if mapped.IPv4 != testWANIP {
+				t.Fatalf("mapped to %s, want an address on %s", mapped, net.IP(testWANIP[:]))
+			}
+			if again := sendOut(t, n, testLAN, remote1); again != mapped {
+				t.Fatalf("second packet to %s mapped to %s, want the existing %s", remote1, again, mapped)
+			}
+			if got := sendOut(t, n, testLAN, remote1OtherPort); (got == mapped) != test.samePortReused {
+				t.Errorf("packet to %s mapped to %s, first mapping was %s, want reuse=%v", remote1OtherPort, got, mapped, test.samePortReused)
+			}
+			if got := sendOut(t, n, testLAN, remote2); (got == mapped) != test.otherIPReused {
+				t.Errorf("packet to %s mapped to %s, first mapping was %s, want reuse=%v", remote2, got, mapped, test.otherIPReused)
+			}
+
+			// Other LAN ports never share the mapping.
+			otherLAN := addr(192, 168, 1, 10, 5001)
+			if got := sendOut(t, n, otherLAN, remote1); got == mapped {
+				t.Errorf("%s got the mapping %s of %s", otherLAN, got, testLAN)
+			}
+		})
+	}
+}
+
+// sendIn sends a UDP packet from src to dst through n, and returns
+// its verdict. Packets that are translated must be delivered to want.
+func sendIn(t *testing.T, n *natTranslator, src, dst, want Addr) TranslatorVerdict {
+	t.Helper()
+	bs := buildPacket(protoUDP, src, dst, []byte("pong"))
+	v := n.TranslateInUDP(bs)
+	if v == TranslatorVerdictMangle {
+		p := NewPacket(bs)
+		if got := p.DstAddr(); got != want {
+			t.Fatalf("inbound %s -> %s delivered to %s, want %s", src, dst, got, want)
+		}
+		if got := p.SrcAddr(); got != src {
+			t.Fatalf("inbound %s -> %s rewritten to come from %s", src, dst, got)
+		}
+		checkChecksums(t, bs)
+	}
+	return v
+}
+
+func TestFilteringBehavior(t *testing.T) {
+	remote := addr(198, 51, 100, 7, 3478)
+	remoteOtherPort := addr(198, 51, 100, 7, 9999)
+	otherRemote := addr(198, 51, 100, 8, 3478)
+
+	tests := []struct {
+		filtering FilteringBehavior
+		// Whether packets are let in from a different port on the
+		// remote IP that the LAN client sent to, and from a different
+		// IP.
+		otherPortAllowed bool
+		otherIPAllowed   bool
+	}{
+		{FilteringEndpointIndependent, true, true},
+		{FilteringAddressDependent, true, false},
+		{FilteringAddressAndPortDependent, false, false},
+	}
+	verdict := func(allowed bool) TranslatorVerdict {
+		if allowed {
+			return TranslatorVerdictMangle
+		}
+		return TranslatorVerdictDrop
+	}
+	for _, test := range tests {
+		t.Run(test.filtering.String(), func(t *testing.T) {
+			n := newTestTranslator(TranslatorConfig{Filtering: test.filtering})
+			mapped := sendOut(t, n, testLAN, remote)
+
+			if v := sendIn(t, n, remote, mapped, testLAN); v != TranslatorVerdictMangle {
+				t.Errorf("reply from %s got verdict %d, want mangle", remote, v)
+			}
+			if v, want := sendIn(t, n, remoteOtherPort, mapped, testLAN), verdict(test.otherPortAllowed); v != want {
+				t.Errorf("packet from %s got verdict %d, want %d", remoteOtherPort, v, want)
+			}
+			if v, want := sendIn(t, n, otherRemote, mapped, testLAN), verdict(test.otherIPAllowed); v != want {
+				t.Errorf("packet from %s got verdict %d, want %d", otherRemote, v, want)
+			}
+
+			// Once the LAN client has sent to a remote, the remote is
+			// let in regardless of the filtering behavior.
+			sendOut(t, n, testLAN, otherRemote)
+			if v := sendIn(t, n, otherRemote, mapped, testLAN); v != TranslatorVerdictMangle {
+				t.Errorf("packet from %s after sending to it got verdict %d, want mangle", otherRemote, v)
+			}
+
+			// Nothing gets in without a mapping.
+			unmapped := mapped
+			unmapped.Port++
+			if v := sendIn(t, n, remote, unmapped, testLAN); v != TranslatorVerdictDrop {
+				t.Errorf("packet to unmapped %s got verdict %d, want drop", unmapped, v)
+			}
+		})
+	}
+}
+
+func TestHairpinning(t *testing.T) {
+	remote := addr(198, 51, 100, 7, 3478)
+	lanB := addr(192, 168, 1, 11, 6000)
+
+	tests := []struct {
+		hairpinning HairpinBehavior
+		filtering   FilteringBehavior
+		// Whether lanB's first packet to testLAN's mapping gets
+		// through.
+		allowed bool
+	}{
+		{HairpinNone, FilteringEndpointIndependent, false},
+		{HairpinInternalSource, FilteringEndpointIndependent, true},
+		{HairpinExternalSource, FilteringEndpointIndependent, true},
+		// testLAN hasn't sent anything to lanB's mapping yet.
+		{HairpinInternalSource, FilteringAddressAndPortDependent, false},
+		{HairpinExternalSource, FilteringAddressAndPortDependent, false},
+	}
+	for _, test := range tests {
+		t.Run(test.hairpinning.String()+"/"+test.filtering.String(), func(t *testing.T) {
+			n := newTestTranslator(TranslatorConfig{
+				Hairpinning: test.hairpinning,
+				Filtering:   test.filtering,
+			})
+			mappedA := sendOut(t, n, testLAN, remote)
+			mappedB := sendOut(t, n, lanB, remote)
+
+			// The sender shows up with its LAN address or its mapped
+			// address, and the mapping it sent to always filters on
+			// the mapped one.
+			wantSrc := lanB
+			if test.hairpinning == HairpinExternalSource {
+				wantSrc = mappedB
+			}
+			hairpin := func(allowed bool) {
+				t.Helper()
+				bs := buildPacket(protoUDP, lanB, mappedA, []byte("hi"))
+				v := n.TranslateOutUDP(bs)
+				if !allowed {
+					if v != TranslatorVerdictDrop {
+						t.Fatalf("hairpinned packet got verdict %d, want drop", v)
+					}
+					return
+				}
+				if v != TranslatorVerdictMangle {
+					t.Fatalf("hairpinned packet got verdict %d, want mangle", v)
+				}
+				p := NewPacket(bs)
+				if got := p.DstAddr(); got != testLAN {
+					t.Errorf("hairpinned packet delivered to %s, want %s", got, testLAN)
+				}
+				if got := p.SrcAddr(); got != wantSrc {
+					t.Errorf("hairpinned packet comes from %s, want %s", got, wantSrc)
+				}
+				checkChecksums(t, bs)
+			}
+
+			hairpin(test.allowed)
+			if test.allowed || test.hairpinning == HairpinNone {
+				return
+			}
+			// Like hole punching through two NATs: lanB's dropped
+			// packet opened its own mapping to testLAN's mapping, and
+			// testLAN's answer opens testLAN's mapping to lanB's.
+			bs := buildPacket(protoUDP, testLAN, mappedB, []byte("hi"))
+			if v := n.TranslateOutUDP(bs); v != TranslatorVerdictMangle {
+				t.Fatalf("hairpinned packet to %s got verdict %d, want mangle", mappedB, v)
+			}
+			if got := NewPacket(bs).DstAddr(); got != lanB {
+				t.Fatalf("hairpinned packet to %s delivered to %s, want %s", mappedB, got, lanB)
+			}
+			hairpin(true)
+		})
+	}
+}
+
+// buildEcho returns an ICMP echo message of type typ from src to dst,
+// with identifier id.
+func buildEcho(typ byte, src, dst [4]byte, id uint16) []byte {
+	bs := buildPacket(protoICMP, Addr{IPv4: src, Port: id}, Addr{IPv4: dst}, []byte("ping"))
+	bs[20] = typ
+	_, l4Sum := fullChecksums(bs)
+	binary.BigEndian.PutUint16(l4ChecksumField(bs), l4Sum)
+	return bs
+}
+
+func TestICMPEcho(t *testing.T) {
+	remote := addr(198, 51, 100, 7, 0).IPv4
+	otherRemote := addr(198, 51, 100, 8, 0).IPv4
+	n := newTestTranslator(TranslatorConfig{})
+
+	ping := func(dst [4]byte, id uint16) Addr {
+		t.Helper()
+		bs := buildEcho(icmpEchoRequest, testLAN.IPv4, dst, id)
+		if v := n.TranslateOutICMP(bs); v != TranslatorVerdictMangle {
+			t.Fatalf("echo request to %s got verdict %d, want mangle", net.IP(dst[:]), v)
+		}
+		checkChecksums(t, bs)
+		p := NewPacket(bs)
+		if got := p.DstIP(); got != dst {
+			t.Fatalf("echo request to %s was redirected to %s", net.IP(dst[:]), net.IP(got[:]))
+		}
+		return p.SrcAddr()
+	}
+
+	mapped := ping(remote, 1234)
+	if mapped.IPv4 != testWANIP {
+		t.Fatalf("echo request mapped to %s, want an identifier on %s", mapped, net.IP(testWANIP[:]))
+	}
+	if got := ping(remote, 1234); got != mapped {
+		t.Errorf("second echo request mapped to %s, want the existing %s", got, mapped)
+	}
+	// The identifier only belongs to the LAN end, so it maps the
+	// same regardless of who's pinged.
+	if got := ping(otherRemote, 1234); got != mapped {
+		t.Errorf("echo request to another host mapped to %s, want %s", got, mapped)
+	}
+	if got := ping(remote, 1235); got == mapped {
+		t.Errorf("echo request with another identifier reused the mapping %s", mapped)
+	}
+
+	bs := buildEcho(icmpEchoReply, remote, mapped.IPv4, mapped.Port)
+	if v := n.TranslateInICMP(bs); v != TranslatorVerdictMangle {
+		t.Fatalf("echo reply got verdict %d, want mangle", v)
+	}
+	checkChecksums(t, bs)
+	p := NewPacket(bs)
+	if got, want := p.DstAddr(), (Addr{IPv4: testLAN.IPv4, Port: 1234}); got != want {
+		t.Errorf("echo reply delivered to %s, want %s", got, want)
+	}
+	if got := p.SrcIP(); got != remote {
+		t.Errorf("echo reply rewritten to come from %s", net.IP(got[:]))
+	}
+
+	// Replies need a mapping, and requests only go out.
+	if v := n.TranslateInICMP(buildEcho(icmpEchoReply, remote, mapped.IPv4, mapped.Port+1)); v != TranslatorVerdictDrop {
+		t.Errorf("echo reply to unmapped identifier %d got verdict %d, want drop", mapped.Port+1, v)
+	}
+	if v := n.TranslateInICMP(buildEcho(icmpEchoRequest, remote, mapped.IPv4, mapped.Port)); v != TranslatorVerdictDrop {
+		t.Errorf("inbound echo request got verdict %d, want drop", v)
+	}
+}
+
+func TestPingWANIP(t *testing.T) {
+	n := newTestTranslator(TranslatorConfig{})
+	bs := buildEcho(icmpEchoRequest, testLAN.IPv4, testWANIP, 1234)
+	orig := append([]byte(nil), bs...)
+	if v := n.TranslateOutICMP(bs); v != TranslatorVerdictAccept {
+		t.Fatalf("ping of the WAN IP got verdict %d, want accept", v)
+	}
+	if string(bs) != string(orig) {
+		t.Errorf("ping of the WAN IP was rewritten to %x", bs)
+	}
+	if got := len(n.Mappings(MappingFilter{})); got != 0 {
+		t.Errorf("ping of the WAN IP created %d mappings, want 0", got)
+	}
+}
+
+func TestTableOverflow(t *testing.T) {
+	remote := addr(198, 51, 100, 7, 3478)
+	lan := func(i int) Addr {
+		return addr(192, 168, 1, 10, uint16(5000+i))
+	}
+
+	tests := []struct {
+		overflow OverflowBehavior
+		// evicted is the index of the LAN port whose mapping makes
+		// room for a new one, or -1 if the new flow is dropped.
+		evicted int
+	}{
+		{OverflowDrop, -1},
+		{OverflowEvictOldest, 0},
+		{OverflowEvictLRU, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.overflow.String(), func(t *testing.T) {
+			n := newTestTranslator(TranslatorConfig{
+				MaxMappings:   3,
+				TableOverflow: test.overflow,
+			})
+			for i := 0; i < 3; i++ {
+				sendOut(t, n, lan(i), remote)
+			}
+			// Make the oldest mapping the most recently used.
+			sendOut(t, n, lan(0), remote)
+
+			bs := buildPacket(protoUDP, lan(3), remote, nil)
+			v := n.TranslateOutUDP(bs)
+			if test.evicted < 0 {
+				if v != TranslatorVerdictDrop {
+					t.Fatalf("new flow into full table got verdict %d, want drop", v)
+				}
+			} else if v != TranslatorVerdictMangle {
+				t.Fatalf("new flow into full table got verdict %d, want mangle", v)
+			}
+
+			ms := n.Mappings(MappingFilter{})
+			if len(ms) != 3 {
+				t.Fatalf("table holds %d mappings, want 3", len(ms))
+			}
+			if test.evicted < 0 {
+				return
+			}
+			for _, m := range ms {
+				if m.Original == lan(test.evicted) {
+					t.Fatalf("mapping of %s survived, want it evicted", m.Original)
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaOverflow(t *testing.T) {
+	remote := addr(198, 51, 100, 7, 3478)
+	lan := func(i int) Addr {
+		return addr(192, 168, 1, 10, uint16(5000+i))
+	}
+	otherHost := addr(192, 168, 1, 11, 5000)
+
+	tests := []struct {
+		overflow OverflowBehavior
+		// evicted is the index of the LAN port whose mapping makes
+		// room for a new one, or -1 if the new flow is dropped.
+		evicted int
+	}{
+		{OverflowDrop, -1},
+		{OverflowEvictOldest, 0},
+		{OverflowEvictLRU, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.overflow.String(), func(t *testing.T) {
+			n := newTestTranslator(TranslatorConfig{
+				HostQuota:     3,
+				QuotaOverflow: test.overflow,
+			})
+			for i := 0; i < 3; i++ {
+				sendOut(t, n, lan(i), remote)
+			}
+			// Make the oldest mapping the most recently used.
+			sendOut(t, n, lan(0), remote)
+			// Other hosts have quotas of their own.
+			sendOut(t, n, otherHost, remote)
+			if got := atomic.LoadUint64(&n.metrics.quotaHits); got != 0 {
+				t.Fatalf("%d quota hits before reaching the quota, want 0", got)
+			}
+
+			bs := buildPacket(protoUDP, lan(3), remote, nil)
+			v := n.TranslateOutUDP(bs)
+			if test.evicted < 0 {
+				if v != TranslatorVerdictDrop {
+					t.Fatalf("new flow over the quota got verdict %d, want drop", v)
+				}
+			} else if v != TranslatorVerdictMangle {
+				t.Fatalf("new flow over the quota got verdict %d, want mangle", v)
+			}
+			if got := atomic.LoadUint64(&n.metrics.quotaHits); got != 1 {
+				t.Errorf("%d quota hits, want 1", got)
+			}
+
+			ms := n.Mappings(MappingFilter{})
+			if len(ms) != 4 {
+				t.Fatalf("table holds %d mappings, want 3 for the host at its quota and 1 for %s", len(ms), net.IP(otherHost.IPv4[:]))
+			}
+			for _, m := range ms {
+				if test.evicted >= 0 && m.Original == lan(test.evicted) {
+					t.Fatalf("mapping of %s survived, want it evicted", m.Original)
+				}
+				if test.evicted < 0 && m.Original == lan(3) {
+					t.Fatalf("dropped flow from %s got a mapping", m.Original)
+				}
+			}
+		})
+	}
+}
+
+func TestTableCapacityConcurrent(t *testing.T) {
+	const max = 50
+	n := newTestTranslator(TranslatorConfig{
+		MaxMappings:   max,
+		TableOverflow: OverflowEvictLRU,
+	})
+	remote := addr(198, 51, 100, 7, 3478)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				// Spread the LAN hosts over many shards.
+				src := addr(10, byte(w), byte(i), 1, uint16(1024+i))
+				n.TranslateOutUDP(buildPacket(protoUDP, src, remote, nil))
+				if got := atomic.LoadInt64(&n.metrics.mappings); got > max {
+					t.Errorf("table holds %d mappings, over the maximum of %d", got, max)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if got := len(n.Mappings(MappingFilter{})); got != max {
+		t.Fatalf("table holds %d mappings, want %d", got, max)
+	}
+	created, used := 0, 0
+	for i := range n.hosts {
+		created += n.hosts[i].byCreation.Len()
+		used += n.hosts[i].byUse.Len()
+	}
+	if created != max || used != max {
+		t.Fatalf("age lists hold %d/%d mappings, want %d", created, used, max)
+	}
+}
+
+func TestLoweredLimits(t *testing.T) {
+	remote := addr(198, 51, 100, 7, 3478)
+	tests := []struct {
+		name  string
+		lower func(*TranslatorConfig)
+		// src is the source of the i-th flow.
+		src func(i int) Addr
+	}{
+		{
+			name:  "max-mappings",
+			lower: func(cfg *TranslatorConfig) { cfg.MaxMappings = 3 },
+			src:   func(i int) Addr { return addr(192, 168, 1, byte(10+i), 5000) },
+		},
+		{
+			name:  "host-quota",
+			lower: func(cfg *TranslatorConfig) { cfg.HostQuota = 3 },
+			src:   func(i int) Addr { return addr(192, 168, 1, 10, uint16(5000+i)) },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestTranslator(TranslatorConfig{
+				HostQuota:     10,
+				QuotaOverflow: OverflowEvictLRU,
+				MaxMappings:   10,
+				TableOverflow: OverflowEvictLRU,
+			})
+			for i := 0; i < 10; i++ {
+				sendOut(t, n, test.src(i), remote)
+			}
+			cfg := *n.cfg()
+			test.lower(&cfg)
+			n.SetConfig(&cfg)
+
+			// The first new flow shrinks the table to the new limit.
+			sendOut(t, n, test.src(10), remote)
+			if got := len(n.Mappings(MappingFilter{})); got != 3 {
+				t.Fatalf("table holds %d mappings after lowering the limit, want 3", got)
+			}
+			for i := 11; i < 15; i++ {
+				sendOut(t, n, test.src(i), remote)
+			}
+			if got := len(n.Mappings(MappingFilter{})); got != 3 {
+				t.Fatalf("table holds %d mappings, want 3", got)
+			}
+		})
+	}
+}
+
+// buildICMPError returns a port unreachable error from src to dst,
+// quoting the first bytes of the packet quoted.
+func buildICMPError(src, dst Addr, quoted []byte) []byte {
+	bs := buildPacket(protoICMP, src, dst, quoted[:28])
+	bs[20], bs[21] = icmpDestinationUnreachable, 3
+	binary.BigEndian.PutUint32(bs[24:28], 0)
+	_, l4Sum := fullChecksums(bs)
+	binary.BigEndian.PutUint16(l4ChecksumField(bs), l4Sum)
+	return bs
+}
+
+func TestICMPErrorOut(t *testing.T) {
+	remote := addr(198, 51, 100, 7, 3478)
+	n := newTestTranslator(TranslatorConfig{TranslateICMP: true})
+	mapped := sendOut(t, n, testLAN, remote)
+	// The error quotes the reply as the LAN client received it.
+	reply := buildPacket(protoUDP, remote, testLAN, []byte("pong"))
+
+	bs := buildICMPError(testLAN, remote, reply)
+	if v := n.TranslateOutICMP(bs); v != TranslatorVerdictMangle {
+		t.Fatalf("ICMP error from %s got verdict %d, want mangle", testLAN, v)
+	}
+	p := NewPacket(bs)
+	if got := p.SrcIP(); got != mapped.IPv4 {
+		t.Errorf("ICMP error sent from %s, want %s", net.IP(got[:]), net.IP(mapped.IPv4[:]))
+	}
+	if got := p.ICMPQuote().DstAddr(); got != mapped {
+		t.Errorf("ICMP error quotes a packet to %s, want %s", got, mapped)
+	}
+
+	// Other LAN hosts can't report errors about the mapping.
+	other := addr(192, 168, 1, 11, 0)
+	bs = buildICMPError(other, remote, reply)
+	if v := n.TranslateOutICMP(bs); v != TranslatorVerdictDrop {
+		t.Errorf("ICMP error from %s about the mapping of %s got verdict %d, want drop", other, testLAN, v)
+	}
+}
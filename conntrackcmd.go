@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// exitOnError makes the errors of a conntrack subcommand exit the
+// program with a plain message, rather than go unreported.
+func exitOnError(action cli.ActionFunc) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		if err := action(c); err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		return nil
+	}
+}
+
+func conntrackList(c *cli.Context) error {
+	f, err := mappingFilter(c)
+	if err != nil {
+		return err
+	}
+	client, err := newControlClient(c)
+	if err != nil {
+		return err
+	}
+	ms, err := client.mappings(http.MethodGet, f)
+	if err != nil {
+		return err
+	}
+	if c.Bool("json") {
+		bs, err := json.MarshalIndent(ms, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bs))
+		return nil
+	}
+	now := time.Now()
+	for _, m := range ms {
+		fmt.Println(formatMapping(m, now))
+	}
+	fmt.Fprintf(os.Stderr, "%d mappings shown\n", len(ms))
+	return nil
+}
+
+func conntrackWatch(c *cli.Context) error {
+	f, err := mappingFilter(c)
+	if err != nil {
+		return err
+	}
+	interval := c.Duration("interval")
+	if interval <= 0 {
+		return fmt.Errorf("--interval must be positive, got %s", interval)
+	}
+	client, err := newControlClient(c)
+	if err != nil {
+		return err
+	}
+
+	// Mappings are identified by their WAN address and creation time,
+	// since port overloading can reuse WAN addresses.
+	type id struct {
+		mapped  Addr
+		created time.Time
+	}
+	var prev map[id]Mapping
+	for {
+		ms, err := client.mappings(http.MethodGet, f)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		cur := map[id]Mapping{}
+		for _, m := range ms {
+			k := id{m.Mapped, m.Created}
+			cur[k] = m
+			old, ok := prev[k]
+			switch {
+			case prev != nil && !ok:
+				fmt.Println("[NEW]", formatMapping(m, now))
+			case ok && (old.PacketsOut != m.PacketsOut || old.PacketsIn != m.PacketsIn):
+				fmt.Println("[UPDATE]", formatMapping(m, now))
+			}
+		}
+		for k, m := range prev {
+			if _, ok := cur[k]; !ok {
+				fmt.Println("[DESTROY]", formatMapping(m, now))
+			}
+		}
+		if prev == nil {
+			fmt.Fprintf(os.Stderr, "Watching %d mappings, polling every %s\n", len(ms), interval)
+		}
+		prev = cur
+		time.Sleep(interval)
+	}
+}
+
+func conntrackDelete(c *cli.Context) error {
+	f, err := mappingFilter(c)
+	if err != nil {
+		return err
+	}
+	if f.Query() == "" {
+		return errors.New("delete needs at least one filter, use flush to delete all mappings")
+	}
+	return deleteMappings(c, f)
+}
+
+func conntrackFlush(c *cli.Context) error {
+	return deleteMappings(c, MappingFilter{})
+}
+
+func deleteMappings(c *cli.Context, f MappingFilter) error {
+	client, err := newControlClient(c)
+	if err != nil {
+		return err
+	}
+	ms, err := client.mappings(http.MethodDelete, f)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, m := range ms {
+		fmt.Println(formatMapping(m, now))
+	}
+	fmt.Fprintf(os.Stderr, "%d mappings deleted\n", len(ms))
+	return nil
+}
+
+// mappingFilter returns the MappingFilter described by the filter
+// flags of a conntrack subcommand.
+func mappingFilter(c *cli.Context) (MappingFilter, error) {
+	var ret MappingFilter
+	if s := c.String("proto"); s != "" {
+		p, err := parseProto(s)
+		if err != nil {
+			return ret, fmt.Errorf("parsing --proto: %s", err)
+		}
+		ret.Proto = p
+	}
+	for _, a := range []struct {
+		name string
+		f    *AddrFilter
+	}{
+		{"original", &ret.Original},
+		{"mapped", &ret.Mapped},
+		{"remote", &ret.Remote},
+	} {
+		if s := c.String(a.name); s != "" {
+			if err := a.f.UnmarshalText([]byte(s)); err != nil {
+				return ret, fmt.Errorf("parsing --%s: %s", a.name, err)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// formatMapping returns a one-line description of m, as of now.
+func formatMapping(m Mapping, now time.Time) string {
+	var remotes []string
+	for _, r := range m.Remotes {
+		remotes = append(remotes, r.String())
+	}
+	expires := m.Deadline.Sub(now).Round(time.Second)
+	if expires < 0 {
+		expires = 0
+	}
+	ret := fmt.Sprintf("%-4s %s <> %s remotes=%s expires=%s packets=%d/%d bytes=%d/%d",
+		m.Proto, m.Original, m.Mapped, strings.Join(remotes, ","), expires,
+		m.PacketsOut, m.PacketsIn, m.BytesOut, m.BytesIn)
+	if m.Established {
+		ret += " established"
+	}
+	return ret
+}
+
+// controlClient talks to the control API of a running nat command.
+type controlClient struct {
+	base string
+	http *http.Client
+}
+
+// newControlClient returns a client for the control API at the
+// address given by --control.
+func newControlClient(c *cli.Context) (*controlClient, error) {
+	addr := c.String("control")
+	if addr == "" {
+		return nil, errors.New("--control must be set to the address of the nat command's control API")
+	}
+	if !strings.Contains(addr, "/") {
+		return &controlClient{
+			base: "http://" + addr,
+			http: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", addr)
+	}
+	return &controlClient{
+		// The host is ignored, all requests go to the socket.
+		base: "http://natlab",
+		http: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dial},
+		},
+	}, nil
+}
+
+// mappings sends a method request for the mappings selected by f, and
+// returns the mappings in the response.
+func (c *controlClient) mappings(method string, f MappingFilter) ([]Mapping, error) {
+	url := c.base + "/mappings"
+	if q := f.Query(); q != "" {
+		url += "?" + q
+	}
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control API: %s", strings.TrimSpace(string(bs)))
+	}
+	var ret []Mapping
+	if err := json.Unmarshal(bs, &ret); err != nil {
+		return nil, fmt.Errorf("decoding control API response: %s", err)
+	}
+	return ret, nil
+}
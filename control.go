@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.universe.tf/natlab/internal/enum"
+)
+
+var protoNames = enum.Names{
+	"udp":  protoUDP,
+	"tcp":  protoTCP,
+	"icmp": protoICMP,
+}
+
+func protoName(proto byte) string {
+	return protoNames.Name("proto", int(proto))
+}
+
+// parseProto parses the name of a protocol that can be mapped.
+func parseProto(s string) (byte, error) {
+	v, err := protoNames.Parse("protocol", []byte(s))
+	return byte(v), err
+}
+
+// Mapping is a snapshot of a mapping, as reported by the control
+// API.
+type Mapping struct {
+	Proto    string    `json:"proto"`
+	Original Addr      `json:"original"`
+	Mapped   Addr      `json:"mapped"`
+	Remotes  []Addr    `json:"remotes"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last-used"`
+	Deadline time.Time `json:"deadline"`
+	Timeout  Duration  `json:"timeout"`
+	// Packet and byte counters, outbound and inbound.
+	PacketsOut uint64 `json:"packets-out"`
+	PacketsIn  uint64 `json:"packets-in"`
+	BytesOut   uint64 `json:"bytes-out"`
+	BytesIn    uint64 `json:"bytes-in"`
+	// Established is set for TCP mappings that have at least one
+	// established connection.
+	Established bool `json:"established,omitempty"`
+}
+
+// snapshot returns a Mapping describing ct, whose hostShard must be
+// locked.
+func (e *ctEntry) snapshot() Mapping {
+	ret := Mapping{
+		Proto:       protoName(e.Proto),
+		Original:    e.Original,
+		Mapped:      e.Mapped,
+		Remotes:     []Addr{},
+		Created:     e.Created,
+		LastUsed:    e.LastUsed,
+		Deadline:    e.Deadline,
+		Timeout:     Duration{e.Timeout},
+		PacketsOut:  e.PacketsOut,
+		PacketsIn:   e.PacketsIn,
+		BytesOut:    e.BytesOut,
+		BytesIn:     e.BytesIn,
+		Established: e.Proto == protoTCP && e.tcpEstablished(),
+	}
+	for r := range e.Remotes {
+		ret.Remotes = append(ret.Remotes, r)
+	}
+	sort.Slice(ret.Remotes, func(i, j int) bool {
+		return addrLess(ret.Remotes[i], ret.Remotes[j])
+	})
+	return ret
+}
+
+// sortMappings sorts ms from oldest to newest.
+func sortMappings(ms []Mapping) {
+	sort.Slice(ms, func(i, j int) bool {
+		if !ms[i].Created.Equal(ms[j].Created) {
+			return ms[i].Created.Before(ms[j].Created)
+		}
+		return addrLess(ms[i].Mapped, ms[j].Mapped)
+	})
+}
+
+func addrLess(a, b Addr) bool {
+	if c := bytes.Compare(a.IPv4[:], b.IPv4[:]); c != 0 {
+		return c < 0
+	}
+	return a.Port < b.Port
+}
+
+// MappingFilter selects mappings by protocol and addresses. The zero
+// MappingFilter matches every mapping.
+type MappingFilter struct {
+	// Proto is the protocol of the mapping, or zero for any.
+	Proto byte
+	// Original and Mapped match the LAN and WAN addresses of the
+	// mapping.
+	Original AddrFilter
+	Mapped   AddrFilter
+	// Remote matches if any of the mapping's remotes matches.
+	Remote AddrFilter
+}
+
+// matches reports whether ct, whose hostShard must be locked, is
+// selected by f.
+func (f MappingFilter) matches(ct *ctEntry) bool {
+	if f.Proto != 0 && f.Proto != ct.Proto {
+		return false
+	}
+	if !f.Original.matches(ct.Original) || !f.Mapped.matches(ct.Mapped) {
+		return false
+	}
+	if f.Remote.IP == nil {
+		return true
+	}
+	for r := range ct.Remotes {
+		if f.Remote.matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Query returns the URL query parameters that select the same
+// mappings as f.
+func (f MappingFilter) Query() string {
+	var ret []string
+	if f.Proto != 0 {
+		ret = append(ret, "proto="+protoName(f.Proto))
+	}
+	for _, a := range []struct {
+		name string
+		f    AddrFilter
+	}{
+		{"original", f.Original},
+		{"mapped", f.Mapped},
+		{"remote", f.Remote},
+	} {
+		if a.f.IP != nil {
+			ret = append(ret, a.name+"="+a.f.String())
+		}
+	}
+	return strings.Join(ret, "&")
+}
+
+// parseMappingFilter parses the URL query parameters of a control
+// API request into a MappingFilter.
+func parseMappingFilter(r *http.Request) (MappingFilter, error) {
+	var ret MappingFilter
+	for k, vs := range r.URL.Query() {
+		if len(vs) != 1 {
+			return ret, fmt.Errorf("filter %q given more than once", k)
+		}
+		v := vs[0]
+		switch k {
+		case "proto":
+			p, err := parseProto(v)
+			if err != nil {
+				return ret, err
+			}
+			ret.Proto = p
+		case "original":
+			if err := ret.Original.UnmarshalText([]byte(v)); err != nil {
+				return ret, err
+			}
+		case "mapped":
+			if err := ret.Mapped.UnmarshalText([]byte(v)); err != nil {
+				return ret, err
+			}
+		case "remote":
+			if err := ret.Remote.UnmarshalText([]byte(v)); err != nil {
+				return ret, err
+			}
+		default:
+			return ret, fmt.Errorf("unknown filter %q, must be one of: mapped, original, proto, remote", k)
+		}
+	}
+	return ret, nil
+}
+
+// AddrFilter matches addresses with a given IP, and also a given
+// port if Port is nonzero. An AddrFilter with a nil IP matches every
+// address.
+type AddrFilter struct {
+	IP   net.IP
+	Port uint16
+}
+
+func (f AddrFilter) matches(a Addr) bool {
+	if f.IP == nil {
+		return true
+	}
+	return f.IP.Equal(net.IP(a.IPv4[:])) && (f.Port == 0 || f.Port == a.Port)
+}
+
+func (f AddrFilter) String() string {
+	if f.Port == 0 {
+		return f.IP.String()
+	}
+	return net.JoinHostPort(f.IP.String(), strconv.Itoa(int(f.Port)))
+}
+
+// UnmarshalText parses an address filter of the form "192.0.2.1" or
+// "192.0.2.1:1234".
+func (f *AddrFilter) UnmarshalText(bs []byte) error {
+	if ip := net.ParseIP(string(bs)); ip != nil && ip.To4() != nil {
+		*f = AddrFilter{IP: ip.To4()}
+		return nil
+	}
+	var a Addr
+	if err := a.UnmarshalText(bs); err != nil {
+		return fmt.Errorf("invalid address filter %q, must be IP or IP:PORT", string(bs))
+	}
+	*f = AddrFilter{IP: net.IP(a.IPv4[:]), Port: a.Port}
+	return nil
+}
+
+// liveSettings are the profile settings that can be changed while
+// the NAT is running. The others are baked into the port manager,
+// the reaper or the packet queues at startup, or in the case of
+// mapping, into the keys of the NAT table.
+var liveSettings = map[string]bool{
+	"filtering":               true,
+	"hairpinning":             true,
+	"mapping-timeout":         true,
+	"port-timeout":            true,
+	"tcp-established-timeout": true,
+	"tcp-transitory-timeout":  true,
+	"icmp-timeout":            true,
+	"refresh":                 true,
+	"icmp":                    true,
+	"zero-checksums":          true,
+	"host-quota":              true,
+	"quota-overflow":          true,
+	"max-mappings":            true,
+	"table-overflow":          true,
+}
+
+// maxPatchSize is the largest PATCH /config body that the control API
+// accepts.
+const maxPatchSize = 64 << 10
+
+// controlServer serves the runtime control API of a Translator.
+type controlServer struct {
+	translator Translator
+
+	// mu guards profile, which is the profile the translator's
+	// current policy was built from.
+	mu      sync.Mutex
+	profile *Profile
+}
+
+// newControlServer returns the control API handler for translator,
+// which was configured from profile.
+func newControlServer(translator Translator, profile *Profile) http.Handler {
+	s := &controlServer{
+		translator: translator,
+		profile:    profile,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mappings", s.mappings)
+	mux.HandleFunc("/config", s.config)
+	return mux
+}
+
+// mappings lists (GET) or deletes (DELETE) the mappings selected by
+// the request's query parameters. A DELETE without parameters
+// flushes the whole NAT table.
+func (s *controlServer) mappings(w http.ResponseWriter, r *http.Request) {
+	f, err := parseMappingFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.translator.Mappings(f))
+	case http.MethodDelete:
+		deleted := s.translator.DeleteMappings(f)
+		if q := f.Query(); q != "" {
+			log.Infof("Deleted %d mappings matching %s on request", len(deleted), q)
+		} else {
+			log.Infof("Flushed %d mappings on request", len(deleted))
+		}
+		writeJSON(w, deleted)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// config returns (GET) or updates (PATCH) the NAT profile. A PATCH
+// carries a JSON object with the settings to change, which must all
+// be liveSettings.
+func (s *controlServer) config(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.profile)
+	case http.MethodPatch:
+		bs, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next, err := s.patchProfile(bs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.translator.SetConfig(next.TranslatorConfig())
+		s.profile = next
+		log.Infof("NAT policy changed on request: %s", bytes.TrimSpace(bs))
+		writeJSON(w, s.profile)
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// patchProfile returns a copy of the current profile with the
+// settings in the JSON object bs applied. s.mu must be held.
+func (s *controlServer) patchProfile(bs []byte) (*Profile, error) {
+	// Decode into a scratch profile first, to report unknown and
+	// malformed settings before checking that they're live.
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&Profile{}); err != nil {
+		return nil, err
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(bs, &keys); err != nil {
+		return nil, err
+	}
+	for k := range keys {
+		if !liveSettings[k] {
+			return nil, fmt.Errorf("%s cannot be changed while the NAT is running", k)
+		}
+	}
+
+	next := *s.profile
+	// The translator may still be reading the current list, so the
+	// decoder must not reuse its backing array.
+	next.PortTimeouts = append([]PortTimeout(nil), s.profile.PortTimeouts...)
+	if err := json.Unmarshal(bs, &next); err != nil {
+		return nil, err
+	}
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(bs, '\n'))
+}
+
+// controlListenAddr returns the address to serve the control API on,
+// given as a TCP host:port or the path of a unix socket. The API is
+// unauthenticated and can rewrite the NAT's policy, so TCP addresses
+// must be on loopback. A missing host means 127.0.0.1.
+func controlListenAddr(addr string) (string, error) {
+	if strings.Contains(addr, "/") {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("%s is not a loopback address, use a unix socket to reach the control API from elsewhere", host)
+	}
+	return addr, nil
+}
+
+// listenHTTP listens for HTTP connections on addr, which is either a
+// TCP host:port, or the path of a unix socket.
+func listenHTTP(addr string) (net.Listener, error) {
+	if !strings.Contains(addr, "/") {
+		return net.Listen("tcp", addr)
+	}
+	// Clean up the socket of a previous run, but nothing else.
+	if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr)
+	}
+	return net.Listen("unix", addr)
+}
+
+// serveHTTP serves handler on l until ctx is canceled.
+func serveHTTP(ctx context.Context, l net.Listener, handler http.Handler) {
+	srv := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		log.Errorf("HTTP server on %s stopped: %s", l.Addr(), err)
+	}
+}
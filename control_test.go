@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestControlListenAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+		ok   bool
+	}{
+		{":8080", "127.0.0.1:8080", true},
+		{"127.0.0.1:8080", "127.0.0.1:8080", true},
+		{"127.0.0.2:8080", "127.0.0.2:8080", true},
+		{"[::1]:8080", "[::1]:8080", true},
+		{"localhost:8080", "localhost:8080", true},
+		{"/run/natlab.sock", "/run/natlab.sock", true},
+		{"0.0.0.0:8080", "", false},
+		{"[::]:8080", "", false},
+		{"192.0.2.1:8080", "", false},
+		{"example.com:8080", "", false},
+		{"8080", "", false},
+	}
+	for _, test := range tests {
+		got, err := controlListenAddr(test.addr)
+		if (err == nil) != test.ok {
+			t.Errorf("controlListenAddr(%q) returned error %v, want ok=%v", test.addr, err, test.ok)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("controlListenAddr(%q) = %q, want %q", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestPatchProfile(t *testing.T) {
+	s := &controlServer{
+		profile: &Profile{
+			LANInterface:          "lan0",
+			WANInterface:          "wan0",
+			Queues:                1,
+			PortAllocationDelta:   1,
+			MappingTimeout:        Duration{2 * time.Minute},
+			TCPEstablishedTimeout: Duration{2 * time.Hour},
+			TCPTransitoryTimeout:  Duration{4 * time.Minute},
+			ICMPTimeout:           Duration{time.Minute},
+			ReapInterval:          Duration{10 * time.Second},
+		},
+	}
+	tests := []struct {
+		patch string
+		ok    bool
+	}{
+		{`{"filtering": "address-dependent"}`, true},
+		{`{"mapping-timeout": "30s", "port-timeout": ["53=5s"]}`, true},
+		{`{"mapping": "address-dependent"}`, false},
+		{`{"port-assignment": "arbitrary"}`, false},
+		{`{"mapping-timeout": "-1s"}`, false},
+		{`{"no-such-setting": true}`, false},
+		{`{"filtering": "sometimes"}`, false},
+	}
+	for _, test := range tests {
+		next, err := s.patchProfile([]byte(test.patch))
+		if (err == nil) != test.ok {
+			t.Errorf("patching %s returned error %v, want ok=%v", test.patch, err, test.ok)
+			continue
+		}
+		if err == nil && next.Mapping != s.profile.Mapping {
+			t.Errorf("patching %s changed the mapping behavior", test.patch)
+		}
+	}
+}
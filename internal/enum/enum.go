@@ -0,0 +1,44 @@
+// Package enum converts the values of natlab's enum types to and from
+// the names used in flags and config files.
+package enum
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Names maps the names of an enum type's values to the values.
+type Names map[string]int
+
+// Name returns the name of v, or typ(v) if v has no name.
+func (n Names) Name(typ string, v int) string {
+	for name, nv := range n {
+		if nv == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("%s(%d)", typ, v)
+}
+
+// Parse returns the value named bs. Unknown names are reported as
+// what, along with the valid names.
+func (n Names) Parse(what string, bs []byte) (int, error) {
+	v, ok := n[string(bs)]
+	if !ok {
+		var valid []string
+		for name := range n {
+			valid = append(valid, name)
+		}
+		return 0, UnknownValue(what, string(bs), valid)
+	}
+	return v, nil
+}
+
+// UnknownValue returns an error saying that got is not a valid what,
+// and listing the valid choices.
+func UnknownValue(what, got string, valid []string) error {
+	valid = append([]string(nil), valid...)
+	sort.Strings(valid)
+	return fmt.Errorf("unknown %s %q, must be one of: %s", what, got, strings.Join(valid, ", "))
+}
@@ -0,0 +1,23 @@
+package enum
+
+import "testing"
+
+func TestNames(t *testing.T) {
+	names := Names{"one": 1, "two": 2}
+
+	if got := names.Name("Number", 2); got != "two" {
+		t.Errorf("Name(2) = %q, want %q", got, "two")
+	}
+	if got := names.Name("Number", 3); got != "Number(3)" {
+		t.Errorf("Name(3) = %q, want %q", got, "Number(3)")
+	}
+
+	if v, err := names.Parse("number", []byte("one")); err != nil || v != 1 {
+		t.Errorf(`Parse("one") = %d, %v, want 1`, v, err)
+	}
+	_, err := names.Parse("number", []byte("three"))
+	want := `unknown number "three", must be one of: one, two`
+	if err == nil || err.Error() != want {
+		t.Errorf(`Parse("three") returned error %v, want %q`, err, want)
+	}
+}
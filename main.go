@@ -1,17 +1,12 @@
 package main
 
 import (
-	"flag"
 	"os"
+	"time"
 
 	"github.com/urfave/cli/v2"
 )
 
-var (
-	lanIf = flag.String("lan-interface", "eth0", "name of the LAN interface")
-	wanIf = flag.String("wan-interface", "eth1", "name of the WAN interface")
-)
-
 func main() {
 	app := &cli.App{
 		Name:  "natlab",
@@ -22,21 +17,251 @@ func main() {
 				Usage: "hook into kernel datapath and operate as a NAT box",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:     "lan-interface",
-						Aliases:  []string{"L"},
-						Required: true,
-						Usage:    "name of the LAN-side network interface",
+						Name:  "config",
+						Usage: "JSON file describing the NAT profile, keyed by flag name; flags given on the command line override it",
+					},
+					&cli.StringFlag{
+						Name:  "preset",
+						Usage: "start from a built-in profile, which --config and other flags override: rfc-ideal, linux-masquerade, symmetric-enterprise, full-cone-home, port-restricted-cone or cgnat",
+					},
+					&cli.BoolFlag{
+						Name:  "print-profile",
+						Usage: "print the resulting NAT profile as JSON, suitable for --config, and exit",
+					},
+					&cli.StringFlag{
+						Name:    "lan-interface",
+						Aliases: []string{"L"},
+						Usage:   "name of the LAN-side network interface (required)",
+					},
+					&cli.StringFlag{
+						Name:    "wan-interface",
+						Aliases: []string{"W"},
+						Usage:   "name of the WAN-side network interface (required)",
+					},
+					&cli.IntFlag{
+						Name:  "queue",
+						Value: 42,
+						Usage: "first NFQUEUE number to consume packets from",
+					},
+					&cli.IntFlag{
+						Name:  "queues",
+						Value: 1,
+						Usage: "number of consecutive NFQUEUE queues to consume, each with its own worker (for iptables --queue-balance)",
+					},
+					&cli.StringFlag{
+						Name:  "control",
+						Usage: "serve the runtime control API on this loopback TCP [host]:port, or unix socket path",
+					},
+					&cli.StringFlag{
+						Name:  "metrics",
+						Usage: "serve Prometheus metrics at /metrics on this TCP host:port, or unix socket path",
+					},
+					&cli.StringFlag{
+						Name:  "address-pooling",
+						Value: "paired",
+						Usage: "WAN IP address pooling behavior (REQ-2): arbitrary, paired or soft-paired",
+					},
+					&cli.StringFlag{
+						Name:  "port-assignment",
+						Value: "port-preserving",
+						Usage: "WAN port assignment behavior (REQ-3): port-overloading, port-preserving or arbitrary",
+					},
+					&cli.BoolFlag{
+						Name:  "port-parity",
+						Usage: "preserve the parity of client ports when assigning WAN ports (REQ-4)",
+					},
+					&cli.BoolFlag{
+						Name:  "port-contiguity",
+						Usage: "when mapping even port x to x', set aside x'+1 for x+1",
+					},
+					&cli.BoolFlag{
+						Name:  "park-sockets",
+						Usage: "reserve mapped WAN ports by binding sockets to them, instead of only tracking them in memory",
+					},
+					&cli.StringFlag{
+						Name:  "port-allocation",
+						Value: "random",
+						Usage: "how WAN ports are picked when not dictated by --port-assignment: random, sequential, delta or per-destination-sequential",
+					},
+					&cli.IntFlag{
+						Name:  "port-allocation-start",
+						Usage: "first WAN port handed out by the sequential and delta port allocations (default: first allowed port)",
+					},
+					&cli.IntFlag{
+						Name:  "port-allocation-delta",
+						Value: 2,
+						Usage: "step between consecutive WAN ports with --port-allocation=delta, may be negative",
+					},
+					&cli.StringSliceFlag{
+						Name:  "port-range",
+						Usage: "range of WAN ports that may be allocated, as PORT-PORT for all WAN IPs or IP=PORT-PORT for one (repeatable)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exclude-ports",
+						Usage: "WAN port or PORT-PORT range that is never allocated (repeatable)",
+					},
+					&cli.Int64Flag{
+						Name:  "seed",
+						Usage: "seed for the NAT's random choices, to replay a previous run's allocations; only deterministic with --queues=1 (default: random)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exhaust-ip",
+						Usage: "WAN IP on which to fail all new allocations, as if all its ports were in use (repeatable)",
+					},
+					&cli.StringFlag{
+						Name:  "mapping",
+						Value: "endpoint-independent",
+						Usage: "mapping reuse behavior (REQ-1): endpoint-independent, address-dependent or address-and-port-dependent",
+					},
+					&cli.StringFlag{
+						Name:  "filtering",
+						Value: "endpoint-independent",
+						Usage: "inbound filtering behavior (REQ-8): endpoint-independent, address-dependent or address-and-port-dependent",
 					},
 					&cli.StringFlag{
-						Name:     "wan-interface",
-						Aliases:  []string{"W"},
-						Required: true,
-						Usage:    "name of the WAN-side network interface",
+						Name:  "hairpinning",
+						Value: "external-source",
+						Usage: "hairpinning behavior (REQ-9): no, internal-source or external-source",
+					},
+					&cli.BoolFlag{
+						Name:  "icmp",
+						Value: true,
+						Usage: "translate ICMP errors for mapped UDP and TCP sessions (REQ-12), rather than dropping them",
+					},
+					&cli.BoolFlag{
+						Name:  "zero-checksums",
+						Usage: "zero the UDP and TCP checksums of translated packets, like a broken NAT would",
+					},
+					&cli.DurationFlag{
+						Name:  "mapping-timeout",
+						Value: 120 * time.Second,
+						Usage: "how long a mapping survives without qualifying traffic (REQ-5)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "port-timeout",
+						Usage: "override --mapping-timeout for traffic to some remote ports, as PORT[-PORT]=DURATION (repeatable)",
+					},
+					&cli.DurationFlag{
+						Name:  "tcp-established-timeout",
+						Value: 124 * time.Minute,
+						Usage: "how long a TCP mapping with an established connection survives without qualifying traffic",
+					},
+					&cli.DurationFlag{
+						Name:  "tcp-transitory-timeout",
+						Value: 4 * time.Minute,
+						Usage: "how long a TCP mapping with only opening or closing connections survives without qualifying traffic",
+					},
+					&cli.DurationFlag{
+						Name:  "icmp-timeout",
+						Value: 60 * time.Second,
+						Usage: "how long an ICMP echo mapping survives without qualifying traffic",
+					},
+					&cli.DurationFlag{
+						Name:  "reap-interval",
+						Value: 10 * time.Second,
+						Usage: "how often to sweep the NAT table for expired mappings",
+					},
+					&cli.StringFlag{
+						Name:  "refresh",
+						Value: "both",
+						Usage: "packets that refresh a mapping (REQ-6): outbound-only, inbound-only or both",
+					},
+					&cli.IntFlag{
+						Name:  "host-quota",
+						Usage: "maximum number of mappings per LAN IP, 0 for no limit",
+					},
+					&cli.StringFlag{
+						Name:  "quota-overflow",
+						Value: "drop",
+						Usage: "what happens when a LAN IP at its --host-quota opens a new flow: drop, evict-oldest or evict-lru",
+					},
+					&cli.IntFlag{
+						Name:  "max-mappings",
+						Usage: "maximum number of mappings in the NAT table, 0 for no limit",
+					},
+					&cli.StringFlag{
+						Name:  "table-overflow",
+						Value: "evict-lru",
+						Usage: "what happens when a new flow arrives and the NAT table holds --max-mappings: drop, evict-oldest or evict-lru",
 					},
 				},
 				Action: nat,
 			},
+			{
+				Name:  "conntrack",
+				Usage: "inspect and delete the mappings of a running NAT box",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "list mappings",
+						Flags: append(filterFlags(), &cli.BoolFlag{
+							Name:  "json",
+							Usage: "print the mappings as JSON",
+						}),
+						Action: exitOnError(conntrackList),
+					},
+					{
+						Name:  "watch",
+						Usage: "print mappings as they are created, used and deleted",
+						Flags: append(filterFlags(), &cli.DurationFlag{
+							Name:  "interval",
+							Value: time.Second,
+							Usage: "how often to poll the NAT for changes",
+						}),
+						Action: exitOnError(conntrackWatch),
+					},
+					{
+						Name:   "delete",
+						Usage:  "delete the mappings that match the filter flags",
+						Flags:  filterFlags(),
+						Action: exitOnError(conntrackDelete),
+					},
+					{
+						Name:   "flush",
+						Usage:  "delete all mappings",
+						Flags:  []cli.Flag{controlFlag()},
+						Action: exitOnError(conntrackFlush),
+					},
+				},
+			},
 		},
 	}
 	app.Run(os.Args)
 }
+
+// controlFlag returns the flag that locates the control API for the
+// conntrack subcommands.
+func controlFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "control",
+		EnvVars: []string{"NATLAB_CONTROL"},
+		Usage:   "address of the nat command's control API, as given to its --control",
+	}
+}
+
+// filterFlags returns the flags of the conntrack subcommands that
+// select mappings, along with controlFlag.
+func filterFlags() []cli.Flag {
+	return []cli.Flag{
+		controlFlag(),
+		&cli.StringFlag{
+			Name:  "proto",
+			Usage: "only mappings of this protocol: udp, tcp or icmp",
+		},
+		&cli.StringFlag{
+			Name:    "original",
+			Aliases: []string{"s"},
+			Usage:   "only mappings with this LAN IP or IP:PORT",
+		},
+		&cli.StringFlag{
+			Name:    "mapped",
+			Aliases: []string{"m"},
+			Usage:   "only mappings with this WAN IP or IP:PORT",
+		},
+		&cli.StringFlag{
+			Name:    "remote",
+			Aliases: []string{"r"},
+			Usage:   "only mappings that have sent to this remote IP or IP:PORT",
+		},
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// dropReason is why a packet was dropped.
+type dropReason int
+
+const (
+	// The packet isn't IPv4 UDP, TCP or ICMP.
+	dropUnparseable dropReason = iota
+	// The packet came in on neither the LAN nor the WAN interface.
+	dropWrongInterface
+	// The packet isn't an ICMP echo request, echo reply or error.
+	dropUnsupported
+	// No mapping exists for the packet, and it may not create one.
+	dropNoMapping
+	// The packet's mapping expired before the reaper got to it.
+	dropExpired
+	// The packet's mapping doesn't accept packets from its sender
+	// (REQ-8).
+	dropFiltered
+	// No WAN port was available for a new mapping.
+	dropAllocationFailure
+	// The LAN host is at its HostQuota.
+	dropQuota
+	// The NAT table holds MaxMappings mappings.
+	dropTableFull
+	// The packet would have hairpinned, but hairpinning is off.
+	dropHairpinDisabled
+	// The packet is an ICMP error, but ICMP translation is off.
+	dropICMPDisabled
+	numDropReasons
+)
+
+var dropReasonNames = [numDropReasons]string{
+	dropUnparseable:       "unparseable",
+	dropWrongInterface:    "wrong_interface",
+	dropUnsupported:       "unsupported",
+	dropNoMapping:         "no_mapping",
+	dropExpired:           "expired",
+	dropFiltered:          "filtered",
+	dropAllocationFailure: "allocation_failure",
+	dropQuota:             "quota",
+	dropTableFull:         "table_full",
+	dropHairpinDisabled:   "hairpin_disabled",
+	dropICMPDisabled:      "icmp_disabled",
+}
+
+var verdictNames = [...]string{
+	TranslatorVerdictAccept: "accept",
+	TranslatorVerdictMangle: "mangle",
+	TranslatorVerdictDrop:   "drop",
+}
+
+// direction is the interface a packet arrived on.
+type direction int
+
+const (
+	directionOut direction = iota
+	directionIn
+	directionUnknown
+	numDirections
+)
+
+var directionNames = [numDirections]string{
+	directionOut:     "out",
+	directionIn:      "in",
+	directionUnknown: "unknown",
+}
+
+// latencyBuckets are the upper bounds of the verdict latency
+// histogram buckets.
+var latencyBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	25 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// Metrics are the NAT's counters, exported in the Prometheus text
+// format. They are updated atomically, and safe for concurrent use.
+type Metrics struct {
+	// The counters come first to keep them 64-bit aligned.
+
+	// mappings is the number of mappings in the NAT table.
+	mappings int64
+	// quotaHits counts the new mappings that exceeded HostQuota.
+	quotaHits uint64
+	// tableFullHits counts the new mappings that exceeded
+	// MaxMappings.
+	tableFullHits uint64
+	packets       [numDirections][len(verdictNames)]uint64
+	drops         [numDropReasons]uint64
+	// latency counts verdicts by the first latencyBuckets bucket they
+	// fit in, with one extra bucket for slower ones.
+	latency      [len(latencyBuckets) + 1]uint64
+	latencyNanos uint64
+
+	// wanIPs holds the counters of each WAN IP. The map itself never
+	// changes after newMetrics.
+	wanIPs map[[4]byte]*wanIPMetrics
+}
+
+// wanIPMetrics are the counters of one WAN IP.
+type wanIPMetrics struct {
+	// allocations counts the mappings created on the IP.
+	allocations uint64
+	// mappings is the number of mappings in the NAT table that are on
+	// the IP.
+	mappings int64
+}
+
+func newMetrics(wanIPs []net.IP) *Metrics {
+	ret := &Metrics{
+		wanIPs: map[[4]byte]*wanIPMetrics{},
+	}
+	for _, ip := range wanIPs {
+		var k [4]byte
+		copy(k[:], ip.To4())
+		ret.wanIPs[k] = &wanIPMetrics{}
+	}
+	return ret
+}
+
+// drop counts a packet dropped for reason, and returns the verdict
+// for it.
+func (m *Metrics) drop(reason dropReason) TranslatorVerdict {
+	atomic.AddUint64(&m.drops[reason], 1)
+	return TranslatorVerdictDrop
+}
+
+// packet counts a packet that arrived from dir and got verdict,
+// which took latency to reach.
+func (m *Metrics) packet(dir direction, verdict TranslatorVerdict, latency time.Duration) {
+	atomic.AddUint64(&m.packets[dir][verdict], 1)
+	i := sort.Search(len(latencyBuckets), func(i int) bool {
+		return latency <= latencyBuckets[i]
+	})
+	atomic.AddUint64(&m.latency[i], 1)
+	atomic.AddUint64(&m.latencyNanos, uint64(latency))
+}
+
+// allocated counts a new mapping on the WAN IP ip.
+func (m *Metrics) allocated(ip [4]byte) {
+	if c := m.wanIPs[ip]; c != nil {
+		atomic.AddUint64(&c.allocations, 1)
+		atomic.AddInt64(&c.mappings, 1)
+	}
+}
+
+// released counts the deletion of a mapping on the WAN IP ip.
+func (m *Metrics) released(ip [4]byte) {
+	if c := m.wanIPs[ip]; c != nil {
+		atomic.AddInt64(&c.mappings, -1)
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// write writes m to w in the Prometheus text format.
+func (m *Metrics) write(w io.Writer) {
+	header := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	header("natlab_packets_total", "counter", "Packets received from NFQUEUE, by arrival direction and verdict.")
+	for dir := range m.packets {
+		for verdict := range m.packets[dir] {
+			fmt.Fprintf(w, "natlab_packets_total{direction=%q,verdict=%q} %d\n", directionNames[dir], verdictNames[verdict], atomic.LoadUint64(&m.packets[dir][verdict]))
+		}
+	}
+
+	header("natlab_drops_total", "counter", "Packets dropped, by reason.")
+	for reason := range m.drops {
+		fmt.Fprintf(w, "natlab_drops_total{reason=%q} %d\n", dropReasonNames[reason], atomic.LoadUint64(&m.drops[reason]))
+	}
+
+	header("natlab_mappings", "gauge", "Mappings in the NAT table.")
+	fmt.Fprintf(w, "natlab_mappings %d\n", atomic.LoadInt64(&m.mappings))
+
+	var ips [][4]byte
+	for ip := range m.wanIPs {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i][:], ips[j][:]) < 0
+	})
+	header("natlab_wan_ip_mappings", "gauge", "Mappings in the NAT table, by WAN IP.")
+	for _, ip := range ips {
+		fmt.Fprintf(w, "natlab_wan_ip_mappings{wan_ip=%q} %d\n", net.IP(ip[:]), atomic.LoadInt64(&m.wanIPs[ip].mappings))
+	}
+	header("natlab_allocations_total", "counter", "Mappings created, by WAN IP.")
+	for _, ip := range ips {
+		fmt.Fprintf(w, "natlab_allocations_total{wan_ip=%q} %d\n", net.IP(ip[:]), atomic.LoadUint64(&m.wanIPs[ip].allocations))
+	}
+
+	header("natlab_quota_hits_total", "counter", "New mappings that found their LAN host at its quota.")
+	fmt.Fprintf(w, "natlab_quota_hits_total %d\n", atomic.LoadUint64(&m.quotaHits))
+	header("natlab_table_full_hits_total", "counter", "New mappings that found the NAT table full.")
+	fmt.Fprintf(w, "natlab_table_full_hits_total %d\n", atomic.LoadUint64(&m.tableFullHits))
+
+	header("natlab_verdict_latency_seconds", "histogram", "Time from receiving a packet from NFQUEUE to issuing its verdict.")
+	var total uint64
+	for i, le := range latencyBuckets {
+		total += atomic.LoadUint64(&m.latency[i])
+		fmt.Fprintf(w, "natlab_verdict_latency_seconds_bucket{le=\"%g\"} %d\n", le.Seconds(), total)
+	}
+	total += atomic.LoadUint64(&m.latency[len(latencyBuckets)])
+	fmt.Fprintf(w, "natlab_verdict_latency_seconds_bucket{le=\"+Inf\"} %d\n", total)
+	fmt.Fprintf(w, "natlab_verdict_latency_seconds_sum %g\n", time.Duration(atomic.LoadUint64(&m.latencyNanos)).Seconds())
+	fmt.Fprintf(w, "natlab_verdict_latency_seconds_count %d\n", total)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWANIPMetrics(t *testing.T) {
+	n := newTestTranslator(TranslatorConfig{})
+	remote := addr(198, 51, 100, 7, 3478)
+	sendOut(t, n, testLAN, remote)
+	sendOut(t, n, addr(192, 168, 1, 11, 5000), remote)
+	if v := n.TranslateOutICMP(buildEcho(icmpEchoRequest, testLAN.IPv4, remote.IPv4, 1234)); v != TranslatorVerdictMangle {
+		t.Fatalf("echo request got verdict %d, want mangle", v)
+	}
+
+	check := func(mappings, allocations int) {
+		t.Helper()
+		var buf bytes.Buffer
+		n.Metrics().write(&buf)
+		ip := net.IP(testWANIP[:])
+		for _, want := range []string{
+			fmt.Sprintf("natlab_wan_ip_mappings{wan_ip=%q} %d\n", ip, mappings),
+			fmt.Sprintf("natlab_allocations_total{wan_ip=%q} %d\n", ip, allocations),
+		} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("metrics don't contain %q:\n%s", want, buf.String())
+			}
+		}
+	}
+	check(3, 3)
+
+	// Mappings leave the gauge however they're deleted, but stay
+	// counted as allocations.
+	n.DeleteMappings(MappingFilter{Proto: protoICMP})
+	check(2, 3)
+	n.Reap(time.Now().Add(time.Hour))
+	check(0, 3)
+}
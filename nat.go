@@ -2,34 +2,41 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
 	"time"
 
 	nfqueue "github.com/florianl/go-nfqueue"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"go.universe.tf/natlab/portmanager"
 )
 
 func nat(c *cli.Context) error {
 	log.Info("Starting")
 
-	config := nfqueue.Config{
-		NfQueue:      42,
-		MaxPacketLen: 65535,
-		MaxQueueLen:  255,
-		Copymode:     nfqueue.NfQnlCopyPacket,
-		ReadTimeout:  10 * time.Millisecond,
-		WriteTimeout: 15 * time.Millisecond,
-	}
-
-	queue, err := nfqueue.Open(&config)
+	profile, err := loadProfile(c)
 	if err != nil {
-		log.Fatalf("Connecting to NFQUEUE: %s", err)
+		log.Fatalf("Invalid NAT profile: %s", err)
+	}
+	if c.Bool("print-profile") {
+		bs, err := json.MarshalIndent(profile, "", "  ")
+		if err != nil {
+			log.Fatalf("Marshaling NAT profile: %s", err)
+		}
+		fmt.Println(string(bs))
+		return nil
+	}
+	if path := c.String("config"); path != "" {
+		log.Infof("Loaded NAT profile from %s", path)
+	}
+	if profile.Preset != "" {
+		log.Infof("NAT preset: %s", profile.Preset)
 	}
-	defer queue.Close()
 
-	wanIPs, err := getWANIPs(*wanIf)
+	wanIPs, err := getWANIPs(profile.WANInterface)
 	if err != nil {
 		log.Fatalf("Getting WAN IPs: %s", err)
 	}
@@ -37,26 +44,155 @@ func nat(c *cli.Context) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	translator := NewAddressAndPortDependentNAT(wanIPs)
+	cfg := profile.TranslatorConfig()
+	if cfg.ZeroChecksums {
+		log.Warn("Zeroing UDP and TCP checksums of translated packets, TCP traffic will break")
+	}
+	log.Infof("Mapping behavior: %s, filtering behavior: %s, hairpinning: %s, ICMP translation: %t", cfg.Mapping, cfg.Filtering, cfg.Hairpinning, cfg.TranslateICMP)
+	log.Infof("Mapping timeout: %s, refreshed by %s packets", cfg.MappingTimeout, cfg.Refresh)
+	for _, t := range cfg.PortTimeouts {
+		log.Infof("Mapping timeout for remote port %s: %s", t.Ports, t.Timeout)
+	}
+	log.Infof("TCP mapping timeouts: %s established, %s transitory", cfg.TCPEstablishedTimeout, cfg.TCPTransitoryTimeout)
+	log.Infof("ICMP echo mapping timeout: %s", cfg.ICMPTimeout)
+	if cfg.HostQuota > 0 {
+		log.Infof("LAN host quota: %d mappings, on overflow: %s", cfg.HostQuota, cfg.QuotaOverflow)
+	}
+	if cfg.MaxMappings > 0 {
+		log.Infof("NAT table capacity: %d mappings, on overflow: %s", cfg.MaxMappings, cfg.TableOverflow)
+	}
 
-	process := func(a nfqueue.Attribute) int {
-		pkt := NewPacket(*a.Payload)
-		if pkt == nil {
-			// We don't know how to handle this kind of packet
-			queue.SetVerdict(*a.PacketID, nfqueue.NfDrop)
-			return 0
+	ports := profile.PortConfig(wanIPs)
+	log.Infof("Random seed: %d (replay with --seed=%d)", ports.Seed, ports.Seed)
+	if profile.Seed != nil && profile.Queues > 1 {
+		log.Warnf("Allocations won't replay deterministically with --seed and %d queues, the queues race for random numbers", profile.Queues)
+	}
+	log.Infof("WAN IPs: %v, address pooling: %s, port assignment: %s", ports.WANIPs, ports.AddressPairing, ports.PortMatching)
+	log.Infof("Port parity preservation: %t, port contiguity: %t, socket parking: %t", ports.PortParity, ports.PortContiguity, ports.ParkSockets)
+	start := "the first allowed port"
+	if ports.PortAllocationStart != 0 {
+		start = fmt.Sprint(ports.PortAllocationStart)
+	}
+	switch ports.PortAllocation {
+	case portmanager.PortAllocationRandom:
+		log.Infof("Port allocation: %s", ports.PortAllocation)
+	case portmanager.PortAllocationDelta:
+		log.Infof("Port allocation: %s by %d, starting at %s", ports.PortAllocation, ports.PortAllocationDelta, start)
+	default:
+		log.Infof("Port allocation: %s, starting at %s", ports.PortAllocation, start)
+	}
+	if ports.PortRange != (portmanager.PortRange{}) {
+		log.Infof("Allowed WAN ports: %s", ports.PortRange)
+	}
+	for ip, r := range ports.IPPortRanges {
+		log.Infof("Allowed WAN ports on %s: %s", ip, r)
+	}
+	if len(ports.ExcludedPorts) > 0 {
+		log.Infof("Excluded WAN ports: %v", ports.ExcludedPorts)
+	}
+	if len(ports.ExhaustedIPs) > 0 {
+		log.Infof("Artificially exhausted WAN IPs: %v", ports.ExhaustedIPs)
+	}
+
+	translator := NewTranslator(cfg, ports)
+
+	go runReaper(ctx, translator, profile.ReapInterval.Duration)
+
+	if profile.Control != "" {
+		addr, err := controlListenAddr(profile.Control)
+		if err != nil {
+			log.Fatalf("Invalid control API address: %s", err)
 		}
-		intf, err := net.InterfaceByIndex(int(*a.InDev))
+		l, err := listenHTTP(addr)
+		if err != nil {
+			log.Fatalf("Listening for control API: %s", err)
+		}
+		go serveHTTP(ctx, l, newControlServer(translator, profile))
+		log.Infof("Serving control API on %s", addr)
+	}
+	if profile.Metrics != "" {
+		l, err := listenHTTP(profile.Metrics)
 		if err != nil {
-			panic(err)
+			log.Fatalf("Listening for metrics: %s", err)
 		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", translator.Metrics())
+		go serveHTTP(ctx, l, mux)
+		log.Infof("Serving metrics on %s/metrics", profile.Metrics)
+	}
+
+	// Each queue gets its own worker, which go-nfqueue runs in its
+	// own goroutine.
+	for i := 0; i < profile.Queues; i++ {
+		config := nfqueue.Config{
+			NfQueue:      uint16(profile.Queue + i),
+			MaxPacketLen: 65535,
+			MaxQueueLen:  255,
+			Copymode:     nfqueue.NfQnlCopyPacket,
+			ReadTimeout:  10 * time.Millisecond,
+			WriteTimeout: 15 * time.Millisecond,
+		}
+		queue, err := nfqueue.Open(&config)
+		if err != nil {
+			log.Fatalf("Connecting to NFQUEUE %d: %s", config.NfQueue, err)
+		}
+		defer queue.Close()
+
+		if err := queue.Register(ctx, packetProcessor(queue, translator, profile.LANInterface, profile.WANInterface)); err != nil {
+			log.Fatalf("Couldn't register packet processor on NFQUEUE %d: %s", config.NfQueue, err)
+		}
+	}
+	log.Infof("Processing packets from NFQUEUE %d-%d", profile.Queue, profile.Queue+profile.Queues-1)
 
-		verdict := TranslatorVerdictDrop
+	<-ctx.Done()
+	log.Info("Exiting")
+
+	return nil
+}
+
+// packetProcessor returns a function that translates the packets
+// coming from queue, which arrive on the interfaces named lanIf and
+// wanIf.
+func packetProcessor(queue *nfqueue.Nfqueue, translator Translator, lanIf, wanIf string) func(nfqueue.Attribute) int {
+	metrics := translator.Metrics()
+	return func(a nfqueue.Attribute) int {
+		start := time.Now()
+		dir := directionUnknown
+		intf, err := net.InterfaceByIndex(int(*a.InDev))
+		if err != nil {
+			// The interface went away, so it's neither the LAN nor
+			// the WAN we were started on.
+			queue.SetVerdict(*a.PacketID, nfqueue.NfDrop)
+			metrics.packet(dir, metrics.drop(dropWrongInterface), time.Since(start))
+			return 0
+		}
 		switch intf.Name {
-		case *lanIf:
+		case lanIf:
+			dir = directionOut
+		case wanIf:
+			dir = directionIn
+		}
+
+		var verdict TranslatorVerdict
+		pkt := NewPacket(*a.Payload)
+		switch {
+		case pkt == nil:
+			// We don't know how to handle this kind of packet
+			verdict = metrics.drop(dropUnparseable)
+		case dir == directionOut && pkt.isUDP4():
 			verdict = translator.TranslateOutUDP(*a.Payload)
-		case *wanIf:
+		case dir == directionOut && pkt.isTCP4():
+			verdict = translator.TranslateOutTCP(*a.Payload)
+		case dir == directionOut && pkt.isICMP4():
+			verdict = translator.TranslateOutICMP(*a.Payload)
+		case dir == directionIn && pkt.isUDP4():
 			verdict = translator.TranslateInUDP(*a.Payload)
+		case dir == directionIn && pkt.isTCP4():
+			verdict = translator.TranslateInTCP(*a.Payload)
+		case dir == directionIn && pkt.isICMP4():
+			verdict = translator.TranslateInICMP(*a.Payload)
+		default:
+			verdict = metrics.drop(dropWrongInterface)
 		}
 
 		switch verdict {
@@ -67,19 +203,10 @@ func nat(c *cli.Context) error {
 		case TranslatorVerdictMangle:
 			queue.SetVerdictModPacket(*a.PacketID, nfqueue.NfAccept, *a.Payload)
 		}
+		metrics.packet(dir, verdict, time.Since(start))
 
 		return 0
 	}
-	err = queue.Register(ctx, process)
-	if err != nil {
-		log.Fatalf("Couldn't register packet processor: %s", err)
-	}
-
-	log.Info("Created tuns")
-	<-ctx.Done()
-	log.Info("Exiting")
-
-	return nil
 }
 
 func getWANIPs(ifName string) ([]net.IP, error) {
@@ -2,37 +2,93 @@ package main
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
+	"strconv"
 )
 
-type UDPAddr struct {
+// Addr is an IPv4 ip:port, of any transport protocol.
+type Addr struct {
 	IPv4 [4]byte
 	Port uint16
 }
 
-func (u UDPAddr) String() string {
+func (u Addr) String() string {
 	a := net.UDPAddr{IP: net.IP(u.IPv4[:]), Port: int(u.Port)}
 	return a.String()
 }
 
-func (u UDPAddr) ToNetUDPAddr() *net.UDPAddr {
+func (u Addr) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// UnmarshalText parses an address of the form "192.0.2.1:1234".
+func (u *Addr) UnmarshalText(bs []byte) error {
+	host, port, err := net.SplitHostPort(string(bs))
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return fmt.Errorf("invalid address %q: %q is not an IPv4 address", string(bs), host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %s", string(bs), err)
+	}
+	copy(u.IPv4[:], ip)
+	u.Port = uint16(p)
+	return nil
+}
+
+func (u Addr) ToNetUDPAddr() *net.UDPAddr {
 	return &net.UDPAddr{
 		IP:   append(net.IP(nil), u.IPv4[:]...),
 		Port: int(u.Port),
 	}
 }
 
-func FromNetUDPAddr(a *net.UDPAddr) UDPAddr {
-	ret := UDPAddr{
+func FromNetUDPAddr(a *net.UDPAddr) Addr {
+	ret := Addr{
+		Port: uint16(a.Port),
+	}
+	copy(ret.IPv4[:], a.IP.To4())
+	return ret
+}
+
+func (u Addr) ToNetTCPAddr() *net.TCPAddr {
+	return &net.TCPAddr{
+		IP:   append(net.IP(nil), u.IPv4[:]...),
+		Port: int(u.Port),
+	}
+}
+
+func FromNetTCPAddr(a *net.TCPAddr) Addr {
+	ret := Addr{
 		Port: uint16(a.Port),
 	}
 	copy(ret.IPv4[:], a.IP.To4())
 	return ret
 }
 
+const (
+	protoICMP = 1
+	protoTCP  = 6
+	protoUDP  = 17
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+
+	icmpEchoReply              = 0
+	icmpDestinationUnreachable = 3
+	icmpEchoRequest            = 8
+	icmpTimeExceeded           = 11
+)
+
 type Packet struct {
 	bytes []byte
-	// FIXME: support for mangling ICMP packets that have UDP4 error payloads
 }
 
 // NewPacket returns a Packet manipulator around the given bytes, if
@@ -41,14 +97,54 @@ func NewPacket(bs []byte) *Packet {
 	ret := &Packet{
 		bytes: bs,
 	}
-	if !ret.isUDP4() {
+	if !ret.isUDP4() && !ret.isTCP4() && !ret.isICMP4() {
 		return nil
 	}
 	return ret
 }
 
+// hasL4Header reports whether the packet is long enough to contain
+// an IPv4 header and the first 8 bytes of the L4 header, which is
+// all that ICMP errors are guaranteed to quote.
+func (p Packet) hasL4Header() bool {
+	return len(p.bytes) >= 20 && p.ipHdrLen() >= 20 && len(p.bytes) >= p.ipHdrLen()+8
+}
+
 func (p Packet) isUDP4() bool {
-	return p.isIPv4() && p.l4proto() == 17
+	return p.hasL4Header() && p.isIPv4() && p.l4proto() == protoUDP
+}
+
+func (p Packet) isTCP4() bool {
+	return p.hasL4Header() && p.isIPv4() && p.l4proto() == protoTCP && len(p.bytes) >= p.ipHdrLen()+20
+}
+
+func (p Packet) isICMP4() bool {
+	return p.isICMP4Echo() || p.isICMP4Error()
+}
+
+// isICMP4Echo reports whether the packet is an ICMP echo request or
+// reply. For these packets, the ICMP identifier stands in for both
+// the source and destination ports.
+func (p Packet) isICMP4Echo() bool {
+	if !p.hasL4Header() || !p.isIPv4() || p.l4proto() != protoICMP {
+		return false
+	}
+	return p.icmpType() == icmpEchoRequest || p.icmpType() == icmpEchoReply
+}
+
+// isICMP4Error reports whether the packet is an ICMP error message
+// quoting a UDP4 or TCP4 packet.
+func (p Packet) isICMP4Error() bool {
+	if !p.hasL4Header() || !p.isIPv4() || p.l4proto() != protoICMP {
+		return false
+	}
+	switch p.icmpType() {
+	case icmpDestinationUnreachable, icmpTimeExceeded:
+		q := p.ICMPQuote()
+		return q.hasL4Header() && q.isIPv4() && (q.l4proto() == protoUDP || q.l4proto() == protoTCP)
+	default:
+		return false
+	}
 }
 
 func (p Packet) isIPv4() bool {
@@ -59,39 +155,121 @@ func (p Packet) l4proto() byte {
 	return p.bytes[9]
 }
 
-func (p Packet) UDPSrcAddr() UDPAddr {
-	ret := UDPAddr{
-		Port: binary.BigEndian.Uint16(p.udpSrcPort()),
+func (p Packet) SrcIP() [4]byte {
+	var ret [4]byte
+	copy(ret[:], p.bytes[12:16])
+	return ret
+}
+
+func (p Packet) SetSrcIP(ip [4]byte) {
+	p.rewrite(p.bytes[12:16], ip[:], true)
+}
+
+func (p Packet) DstIP() [4]byte {
+	var ret [4]byte
+	copy(ret[:], p.bytes[16:20])
+	return ret
+}
+
+func (p Packet) SetDstIP(ip [4]byte) {
+	p.rewrite(p.bytes[16:20], ip[:], true)
+}
+
+func (p Packet) SrcAddr() Addr {
+	ret := Addr{
+		Port: binary.BigEndian.Uint16(p.srcPort()),
 	}
 	copy(ret.IPv4[:], p.bytes[12:16])
 	return ret
 }
 
-func (p Packet) SetUDPSrcAddr(u UDPAddr) {
-	copy(p.bytes[12:16], u.IPv4[:])
-	binary.BigEndian.PutUint16(p.udpSrcPort(), u.Port)
-	p.recomputeChecksum()
+func (p Packet) SetSrcAddr(u Addr) {
+	p.SetSrcIP(u.IPv4)
+	p.setPort(p.srcPort(), u.Port)
 }
 
-func (p Packet) UDPDstAddr() UDPAddr {
-	ret := UDPAddr{
-		Port: binary.BigEndian.Uint16(p.udpDstPort()),
+func (p Packet) DstAddr() Addr {
+	ret := Addr{
+		Port: binary.BigEndian.Uint16(p.dstPort()),
 	}
 	copy(ret.IPv4[:], p.bytes[16:20])
 	return ret
 }
 
-func (p Packet) SetUDPDstAddr(u UDPAddr) {
-	copy(p.bytes[16:20], u.IPv4[:])
-	binary.BigEndian.PutUint16(p.udpDstPort(), u.Port)
-	p.recomputeChecksum()
+func (p Packet) SetDstAddr(u Addr) {
+	p.SetDstIP(u.IPv4)
+	p.setPort(p.dstPort(), u.Port)
+}
+
+func (p Packet) setPort(field []byte, port uint16) {
+	var bs [2]byte
+	binary.BigEndian.PutUint16(bs[:], port)
+	p.rewrite(field, bs[:], false)
+}
+
+// rewrite overwrites field, a 16-bit aligned slice of p's IP or L4
+// header, with val. It incrementally updates all the checksums that
+// cover field (RFC 1624), so that we don't have to walk the entire
+// packet for every rewrite. inIPHeader says whether field is part of
+// the IP header.
+func (p Packet) rewrite(field, val []byte, inIPHeader bool) {
+	old := append([]byte(nil), field...)
+	copy(field, val)
+
+	if inIPHeader {
+		updateChecksum(p.bytes[10:12], old, val)
+	}
+
+	switch p.l4proto() {
+	case protoUDP:
+		// Both the ports and the IPs (via the pseudo-header) are
+		// covered by the UDP checksum. A zero checksum means the
+		// sender didn't compute one, and it must stay that way.
+		sum := p.udpChecksum()
+		if binary.BigEndian.Uint16(sum) == 0 {
+			return
+		}
+		updateChecksum(sum, old, val)
+		if binary.BigEndian.Uint16(sum) == 0 {
+			binary.BigEndian.PutUint16(sum, 0xFFFF)
+		}
+	case protoTCP:
+		if sum := p.tcpChecksum(); sum != nil {
+			updateChecksum(sum, old, val)
+		}
+	case protoICMP:
+		// The ICMP checksum doesn't include a pseudo-header.
+		if !inIPHeader {
+			updateChecksum(p.icmpChecksum(), old, val)
+		}
+	}
+}
+
+// ZeroL4Checksum zeroes out the UDP or TCP checksum, to emulate NATs
+// that don't bother updating them. For TCP, this makes the checksum
+// invalid.
+func (p Packet) ZeroL4Checksum() {
+	switch p.l4proto() {
+	case protoUDP:
+		binary.BigEndian.PutUint16(p.udpChecksum(), 0)
+	case protoTCP:
+		if sum := p.tcpChecksum(); sum != nil {
+			binary.BigEndian.PutUint16(sum, 0)
+		}
+	}
 }
 
-func (p Packet) udpSrcPort() []byte {
+func (p Packet) srcPort() []byte {
+	if p.l4proto() == protoICMP {
+		return p.icmpID()
+	}
 	return p.bytes[p.ipHdrLen() : p.ipHdrLen()+2]
 }
 
-func (p Packet) udpDstPort() []byte {
+func (p Packet) dstPort() []byte {
+	if p.l4proto() == protoICMP {
+		return p.icmpID()
+	}
 	return p.bytes[p.ipHdrLen()+2 : p.ipHdrLen()+4]
 }
 
@@ -99,27 +277,80 @@ func (p Packet) udpChecksum() []byte {
 	return p.bytes[p.ipHdrLen()+6 : p.ipHdrLen()+8]
 }
 
+func (p Packet) tcpFlags() byte {
+	return p.bytes[p.ipHdrLen()+13]
+}
+
+// tcpChecksum returns the TCP checksum field, or nil if the packet is
+// a quote that was truncated before the checksum.
+func (p Packet) tcpChecksum() []byte {
+	if len(p.bytes) < p.ipHdrLen()+18 {
+		return nil
+	}
+	return p.bytes[p.ipHdrLen()+16 : p.ipHdrLen()+18]
+}
+
+func (p Packet) icmpType() byte {
+	return p.bytes[p.ipHdrLen()]
+}
+
+func (p Packet) icmpID() []byte {
+	return p.bytes[p.ipHdrLen()+4 : p.ipHdrLen()+6]
+}
+
+func (p Packet) icmpChecksum() []byte {
+	return p.bytes[p.ipHdrLen()+2 : p.ipHdrLen()+4]
+}
+
+// ICMPQuote returns the packet quoted by an ICMP error message. The
+// quoted packet may be truncated after its first 8 bytes of L4
+// header.
+//
+// Mutating the quoted packet does not update the outer ICMP
+// checksum. Callers must call FixICMPChecksum on the outer packet
+// afterwards.
+func (p Packet) ICMPQuote() *Packet {
+	return &Packet{bytes: p.bytes[p.ipHdrLen()+8:]}
+}
+
 func (p Packet) ipHdrLen() int {
 	return int(p.bytes[0]&0xF) * 4
 }
 
-func (p Packet) recomputeChecksum() {
+// FixICMPChecksum recomputes the ICMP checksum from scratch.
+func (p Packet) FixICMPChecksum() {
+	binary.BigEndian.PutUint16(p.icmpChecksum(), 0)
+	binary.BigEndian.PutUint16(p.icmpChecksum(), checksum(p.bytes[p.ipHdrLen():]))
+}
+
+// updateChecksum incrementally updates the Internet checksum stored
+// in field, after the 16-bit aligned bytes old that it covers were
+// replaced with val (RFC 1624, eqn. 3).
+func updateChecksum(field, old, val []byte) {
+	sum := uint32(^binary.BigEndian.Uint16(field))
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i : i+2]))
+		sum += uint32(binary.BigEndian.Uint16(val[i : i+2]))
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	binary.BigEndian.PutUint16(field, ^uint16(sum))
+}
+
+// checksum returns the Internet checksum (RFC 1071) of bs.
+func checksum(bs []byte) uint16 {
 	var sum uint32
 
-	for i := 0; i < p.ipHdrLen(); i += 2 {
-		if i == 10 {
-			// Skip the checksum field
-			continue
-		}
-		sum += uint32(binary.BigEndian.Uint16(p.bytes[i : i+2]))
+	for i := 0; i+1 < len(bs); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(bs[i : i+2]))
+	}
+	if len(bs)%2 == 1 {
+		sum += uint32(bs[len(bs)-1]) << 8
 	}
 	// In one's complement, each carry should increment the sum.
 	sum = (sum & 0xFFFF) + (sum >> 16)
 	// ... and in some cases, carry increments cause another carry.
 	sum = (sum & 0xFFFF) + (sum >> 16)
-	binary.BigEndian.PutUint16(p.bytes[10:12], ^uint16(sum))
-
-	// Also zero out the UDP checksum, because I can't be bothered to
-	// recompute it.
-	binary.BigEndian.PutUint16(p.udpChecksum(), 0)
+	return ^uint16(sum)
 }
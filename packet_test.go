@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// buildPacket returns an IPv4 packet of protocol proto from src to
+// dst, with correct checksums. ICMP packets are echo requests, with
+// src.Port as the identifier.
+func buildPacket(proto byte, src, dst Addr, payload []byte) []byte {
+	var l4 []byte
+	switch proto {
+	case protoUDP:
+		l4 = make([]byte, 8)
+		binary.BigEndian.PutUint16(l4[0:2], src.Port)
+		binary.BigEndian.PutUint16(l4[2:4], dst.Port)
+		binary.BigEndian.PutUint16(l4[4:6], uint16(8+len(payload)))
+	case protoTCP:
+		l4 = make([]byte, 20)
+		binary.BigEndian.PutUint16(l4[0:2], src.Port)
+		binary.BigEndian.PutUint16(l4[2:4], dst.Port)
+		binary.BigEndian.PutUint32(l4[4:8], 0x12345678)
+		binary.BigEndian.PutUint32(l4[8:12], 0x9abcdef0)
+		l4[12] = 5 << 4
+		l4[13] = tcpFlagSYN | tcpFlagACK
+		binary.BigEndian.PutUint16(l4[14:16], 65535)
+	case protoICMP:
+		l4 = make([]byte, 8)
+		l4[0] = icmpEchoRequest
+		binary.BigEndian.PutUint16(l4[4:6], src.Port)
+		binary.BigEndian.PutUint16(l4[6:8], 1)
+	}
+	l4 = append(l4, payload...)
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(l4)))
+	binary.BigEndian.PutUint16(ip[4:6], 0xbeef)
+	ip[8] = 64
+	ip[9] = proto
+	copy(ip[12:16], src.IPv4[:])
+	copy(ip[16:20], dst.IPv4[:])
+
+	bs := append(ip, l4...)
+	ipSum, l4Sum := fullChecksums(bs)
+	binary.BigEndian.PutUint16(bs[10:12], ipSum)
+	binary.BigEndian.PutUint16(l4ChecksumField(bs), l4Sum)
+	return bs
+}
+
+// l4ChecksumOffset returns the offset of the L4 checksum in an L4
+// header of protocol proto.
+func l4ChecksumOffset(proto byte) int {
+	switch proto {
+	case protoUDP:
+		return 6
+	case protoTCP:
+		return 16
+	default:
+		return 2
+	}
+}
+
+func l4ChecksumField(bs []byte) []byte {
+	off := 20 + l4ChecksumOffset(bs[9])
+	return bs[off : off+2]
+}
+
+// fullChecksums computes the IP and L4 checksums of bs from scratch,
+// ignoring the values currently stored in it.
+func fullChecksums(bs []byte) (ipSum, l4Sum uint16) {
+	ip := append([]byte(nil), bs[:20]...)
+	ip[10], ip[11] = 0, 0
+	ipSum = checksum(ip)
+
+	l4 := append([]byte(nil), bs[20:]...)
+	off := l4ChecksumOffset(bs[9])
+	l4[off], l4[off+1] = 0, 0
+	if bs[9] == protoICMP {
+		return ipSum, checksum(l4)
+	}
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:8], bs[12:20])
+	pseudo[9] = bs[9]
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(l4)))
+	l4Sum = checksum(append(pseudo, l4...))
+	if bs[9] == protoUDP && l4Sum == 0 {
+		l4Sum = 0xFFFF
+	}
+	return ipSum, l4Sum
+}
+
+func checkChecksums(t *testing.T, bs []byte) {
+	t.Helper()
+	wantIP, wantL4 := fullChecksums(bs)
+	if got := binary.BigEndian.Uint16(bs[10:12]); got != wantIP {
+		t.Errorf("IP checksum is %#04x, want %#04x", got, wantIP)
+	}
+	if got := binary.BigEndian.Uint16(l4ChecksumField(bs)); got != wantL4 {
+		t.Errorf("L4 checksum is %#04x, want %#04x", got, wantL4)
+	}
+}
+
+func addr(a, b, c, d byte, port uint16) Addr {
+	return Addr{IPv4: [4]byte{a, b, c, d}, Port: port}
+}
+
+func TestRewriteChecksums(t *testing.T) {
+	lan := addr(192, 168, 1, 10, 5000)
+	wan := addr(203, 0, 113, 1, 61234)
+	remote := addr(198, 51, 100, 7, 3478)
+	extremes := addr(255, 255, 255, 255, 65535)
+	zeros := addr(0, 0, 0, 0, 0)
+
+	tests := []struct {
+		name    string
+		src     Addr
+		dst     Addr
+		rewrite func(*Packet)
+	}{
+		{"outbound", lan, remote, func(p *Packet) { p.SetSrcAddr(wan) }},
+		{"inbound", remote, wan, func(p *Packet) { p.SetDstAddr(lan) }},
+		{"hairpin", lan, wan, func(p *Packet) {
+			p.SetSrcAddr(wan)
+			p.SetDstAddr(lan)
+		}},
+		{"src IP only", lan, remote, func(p *Packet) { p.SetSrcIP(wan.IPv4) }},
+		{"to all ones", lan, remote, func(p *Packet) { p.SetSrcAddr(extremes) }},
+		{"from all ones", extremes, remote, func(p *Packet) { p.SetSrcAddr(lan) }},
+		{"to zeros", lan, remote, func(p *Packet) { p.SetSrcAddr(zeros) }},
+		{"unchanged", lan, remote, func(p *Packet) { p.SetSrcAddr(lan) }},
+	}
+
+	for _, proto := range []byte{protoUDP, protoTCP, protoICMP} {
+		for _, test := range tests {
+			t.Run(protoName(proto)+"/"+test.name, func(t *testing.T) {
+				bs := buildPacket(proto, test.src, test.dst, []byte("hello, world!"))
+				p := NewPacket(bs)
+				if p == nil {
+					t.Fatal("NewPacket rejected the test packet")
+				}
+				test.rewrite(p)
+				checkChecksums(t, bs)
+			})
+		}
+	}
+}
+
+func TestRewriteChecksumsRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randAddr := func() Addr {
+		var a Addr
+		rng.Read(a.IPv4[:])
+		a.Port = uint16(rng.Intn(65536))
+		return a
+	}
+	for _, proto := range []byte{protoUDP, protoTCP, protoICMP} {
+		for i := 0; i < 1000; i++ {
+			payload := make([]byte, rng.Intn(64))
+			rng.Read(payload)
+			bs := buildPacket(proto, randAddr(), randAddr(), payload)
+			p := NewPacket(bs)
+			p.SetSrcAddr(randAddr())
+			p.SetDstAddr(randAddr())
+			checkChecksums(t, bs)
+			if t.Failed() {
+				t.Fatalf("%s packet %d: %x", protoName(proto), i, bs)
+			}
+		}
+	}
+}
+
+func TestRewriteKeepsZeroUDPChecksum(t *testing.T) {
+	bs := buildPacket(protoUDP, addr(192, 168, 1, 10, 5000), addr(198, 51, 100, 7, 3478), nil)
+	binary.BigEndian.PutUint16(bs[26:28], 0)
+	p := NewPacket(bs)
+	p.SetSrcAddr(addr(203, 0, 113, 1, 61234))
+	if got := binary.BigEndian.Uint16(bs[26:28]); got != 0 {
+		t.Errorf("UDP checksum is %#04x, want it left at 0", got)
+	}
+	wantIP, _ := fullChecksums(bs)
+	if got := binary.BigEndian.Uint16(bs[10:12]); got != wantIP {
+		t.Errorf("IP checksum is %#04x, want %#04x", got, wantIP)
+	}
+}
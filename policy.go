@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.universe.tf/natlab/internal/enum"
+	"go.universe.tf/natlab/portmanager"
+)
+
+// MappingBehavior is the NAT's mapping reuse behavior (REQ-1).
+type MappingBehavior int
+
+const (
+	// The mapping X:x <> X':x' is reused for all destinations.
+	MappingEndpointIndependent MappingBehavior = iota
+	// The mapping X:x <> X':x' is reused as long as the destination
+	// IP is the same.
+	MappingAddressDependent
+	// The mapping X:x <> X':x' is reused as long as the destination
+	// IP and port are the same.
+	MappingAddressAndPortDependent
+)
+
+var mappingBehaviorNames = enum.Names{
+	"endpoint-independent":       int(MappingEndpointIndependent),
+	"address-dependent":          int(MappingAddressDependent),
+	"address-and-port-dependent": int(MappingAddressAndPortDependent),
+}
+
+func (m MappingBehavior) String() string {
+	return mappingBehaviorNames.Name("MappingBehavior", int(m))
+}
+
+func (m MappingBehavior) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *MappingBehavior) UnmarshalText(bs []byte) error {
+	v, err := mappingBehaviorNames.Parse("mapping behavior", bs)
+	if err != nil {
+		return err
+	}
+	*m = MappingBehavior(v)
+	return nil
+}
+
+// key returns the byOriginal lookup key for a proto packet going from
+// src to dst, with the parts of dst that don't influence mapping reuse
+// zeroed out.
+func (m MappingBehavior) key(proto byte, src, dst Addr) ctKey {
+	switch m {
+	case MappingEndpointIndependent:
+		return ctKey{Proto: proto, Src: src}
+	case MappingAddressDependent:
+		return ctKey{Proto: proto, Src: src, Dst: Addr{IPv4: dst.IPv4}}
+	case MappingAddressAndPortDependent:
+		return ctKey{Proto: proto, Src: src, Dst: dst}
+	default:
+		panic("unimplemented case")
+	}
+}
+
+// FilteringBehavior is the NAT's inbound filtering behavior (REQ-8).
+type FilteringBehavior int
+
+const (
+	// All inbound packets that match a mapping are allowed.
+	FilteringEndpointIndependent FilteringBehavior = iota
+	// Packets from Y:* are allowed if the LAN client has previously
+	// sent packets to Y.
+	FilteringAddressDependent
+	// Packets from Y:y are allowed if the LAN client has previously
+	// sent packets to Y:y.
+	FilteringAddressAndPortDependent
+)
+
+var filteringBehaviorNames = enum.Names{
+	"endpoint-independent":       int(FilteringEndpointIndependent),
+	"address-dependent":          int(FilteringAddressDependent),
+	"address-and-port-dependent": int(FilteringAddressAndPortDependent),
+}
+
+func (f FilteringBehavior) String() string {
+	return filteringBehaviorNames.Name("FilteringBehavior", int(f))
+}
+
+func (f FilteringBehavior) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+func (f *FilteringBehavior) UnmarshalText(bs []byte) error {
+	v, err := filteringBehaviorNames.Parse("filtering behavior", bs)
+	if err != nil {
+		return err
+	}
+	*f = FilteringBehavior(v)
+	return nil
+}
+
+// allows reports whether an inbound packet from remote may traverse
+// ct.
+func (f FilteringBehavior) allows(ct *ctEntry, remote Addr) bool {
+	switch f {
+	case FilteringEndpointIndependent:
+		return true
+	case FilteringAddressDependent:
+		for r := range ct.Remotes {
+			if r.IPv4 == remote.IPv4 {
+				return true
+			}
+		}
+		return false
+	case FilteringAddressAndPortDependent:
+		return ct.Remotes[remote]
+	default:
+		panic("unimplemented case")
+	}
+}
+
+// HairpinBehavior is the NAT's hairpinning behavior (REQ-9).
+type HairpinBehavior int
+
+const (
+	// Packets from the LAN to one of the NAT's own mappings are
+	// dropped.
+	HairpinNone HairpinBehavior = iota
+	// Hairpinned packets are delivered with the sender's LAN ip:port
+	// as the source.
+	HairpinInternalSource
+	// Hairpinned packets are delivered with the sender's mapped WAN
+	// ip:port as the source.
+	HairpinExternalSource
+)
+
+var hairpinBehaviorNames = enum.Names{
+	"no":              int(HairpinNone),
+	"internal-source": int(HairpinInternalSource),
+	"external-source": int(HairpinExternalSource),
+}
+
+func (h HairpinBehavior) String() string {
+	return hairpinBehaviorNames.Name("HairpinBehavior", int(h))
+}
+
+func (h HairpinBehavior) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *HairpinBehavior) UnmarshalText(bs []byte) error {
+	v, err := hairpinBehaviorNames.Parse("hairpin behavior", bs)
+	if err != nil {
+		return err
+	}
+	*h = HairpinBehavior(v)
+	return nil
+}
+
+// RefreshBehavior determines which packets refresh a mapping's
+// timer (REQ-6).
+type RefreshBehavior int
+
+const (
+	// Only packets going from LAN to WAN refresh the mapping.
+	RefreshOutbound RefreshBehavior = iota
+	// Only packets going from WAN to LAN refresh the mapping.
+	RefreshInbound
+	// Packets going in either direction refresh the mapping.
+	RefreshBoth
+)
+
+var refreshBehaviorNames = enum.Names{
+	"outbound-only": int(RefreshOutbound),
+	"inbound-only":  int(RefreshInbound),
+	"both":          int(RefreshBoth),
+}
+
+func (r RefreshBehavior) String() string {
+	return refreshBehaviorNames.Name("RefreshBehavior", int(r))
+}
+
+func (r RefreshBehavior) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *RefreshBehavior) UnmarshalText(bs []byte) error {
+	v, err := refreshBehaviorNames.Parse("refresh behavior", bs)
+	if err != nil {
+		return err
+	}
+	*r = RefreshBehavior(v)
+	return nil
+}
+
+// outbound reports whether LAN to WAN packets refresh mappings.
+func (r RefreshBehavior) outbound() bool {
+	return r == RefreshOutbound || r == RefreshBoth
+}
+
+// inbound reports whether WAN to LAN packets refresh mappings.
+func (r RefreshBehavior) inbound() bool {
+	return r == RefreshInbound || r == RefreshBoth
+}
+
+// OverflowBehavior is what happens to a new mapping that would
+// exceed a limit on the number of mappings.
+type OverflowBehavior int
+
+const (
+	// The new mapping is not created, and its packet is dropped.
+	OverflowDrop OverflowBehavior = iota
+	// The oldest existing mapping is deleted to make room.
+	OverflowEvictOldest
+	// The least recently used existing mapping is deleted to make
+	// room.
+	OverflowEvictLRU
+)
+
+var overflowBehaviorNames = enum.Names{
+	"drop":         int(OverflowDrop),
+	"evict-oldest": int(OverflowEvictOldest),
+	"evict-lru":    int(OverflowEvictLRU),
+}
+
+func (o OverflowBehavior) String() string {
+	return overflowBehaviorNames.Name("OverflowBehavior", int(o))
+}
+
+func (o OverflowBehavior) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+func (o *OverflowBehavior) UnmarshalText(bs []byte) error {
+	v, err := overflowBehaviorNames.Parse("overflow behavior", bs)
+	if err != nil {
+		return err
+	}
+	*o = OverflowBehavior(v)
+	return nil
+}
+
+// victim returns the mapping in cts to delete to make room for a new
+// one, or nil if the new mapping should be refused.
+func (o OverflowBehavior) victim(cts map[ctKey]*ctEntry) *ctEntry {
+	var ret *ctEntry
+	switch o {
+	case OverflowDrop:
+		return nil
+	case OverflowEvictOldest:
+		for _, ct := range cts {
+			if ret == nil || ct.Created.Before(ret.Created) {
+				ret = ct
+			}
+		}
+	case OverflowEvictLRU:
+		for _, ct := range cts {
+			if ret == nil || ct.LastUsed.Before(ret.LastUsed) {
+				ret = ct
+			}
+		}
+	default:
+		panic("unimplemented case")
+	}
+	return ret
+}
+
+// PortTimeout overrides the mapping timeout for traffic to a range
+// of WAN ports.
+type PortTimeout struct {
+	Ports   portmanager.PortRange
+	Timeout time.Duration
+}
+
+func (t PortTimeout) String() string {
+	return fmt.Sprintf("%s=%s", t.Ports, t.Timeout)
+}
+
+func (t PortTimeout) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText parses a port timeout of the form "53=30s" or
+// "4500-4501=10m".
+func (t *PortTimeout) UnmarshalText(bs []byte) error {
+	fs := strings.SplitN(string(bs), "=", 2)
+	if len(fs) != 2 {
+		return fmt.Errorf("invalid port timeout %q, must be of the form PORT[-PORT]=DURATION", string(bs))
+	}
+	if err := t.Ports.UnmarshalText([]byte(fs[0])); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(fs[1])
+	if err != nil {
+		return fmt.Errorf("invalid port timeout %q: %s", string(bs), err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("invalid port timeout %q: timeout must be positive", string(bs))
+	}
+	t.Timeout = d
+	return nil
+}
@@ -0,0 +1,62 @@
+package portmanager
+
+import (
+	"io"
+)
+
+// portSet is a bitmap of the ports in use on one WAN IP, for one
+// network.
+type portSet [65536 / 64]uint64
+
+func (s *portSet) has(port int) bool {
+	return s[port/64]&(1<<uint(port%64)) != 0
+}
+
+func (s *portSet) add(port int) {
+	s[port/64] |= 1 << uint(port%64)
+}
+
+func (s *portSet) remove(port int) {
+	s[port/64] &^= 1 << uint(port%64)
+}
+
+// free returns the first port of r not in s, scanning upwards from
+// start and wrapping around to r.First after r.Last. It returns 0 if
+// all ports in r are in use.
+func (s *portSet) free(r PortRange, start int) int {
+	first, last := int(r.First), int(r.Last)
+	n := last - first + 1
+	for i := 0; i < n; i++ {
+		port := first + (start-first+i)%n
+		if s[port/64] == ^uint64(0) {
+			// Skip to the end of the full word, or of r. The loop
+			// increment takes care of the last step.
+			skip := 63 - port%64
+			if port+skip > last {
+				skip = last - port
+			}
+			i += skip
+			continue
+		}
+		if !s.has(port) {
+			return port
+		}
+	}
+	return 0
+}
+
+// parkedPort is a port held in a portSet, and optionally by a parking
+// socket. Closing it returns the port to the set.
+type parkedPort struct {
+	set  *portSet
+	port int
+	conn io.Closer
+}
+
+func (p parkedPort) Close() error {
+	p.set.remove(p.port)
+	if p.conn != nil {
+		return p.conn.Close()
+	}
+	return nil
+}
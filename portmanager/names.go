@@ -0,0 +1,73 @@
+package portmanager
+
+import "go.universe.tf/natlab/internal/enum"
+
+var portMatchingNames = enum.Names{
+	"port-preserving":  int(PortMatchingSoft),
+	"port-overloading": int(PortMatchingHard),
+	"arbitrary":        int(PortMatchingNone),
+}
+
+func (m PortMatching) String() string {
+	return portMatchingNames.Name("PortMatching", int(m))
+}
+
+func (m PortMatching) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *PortMatching) UnmarshalText(bs []byte) error {
+	v, err := portMatchingNames.Parse("port matching", bs)
+	if err != nil {
+		return err
+	}
+	*m = PortMatching(v)
+	return nil
+}
+
+var addressPairingNames = enum.Names{
+	"paired":      int(AddressPairingHard),
+	"soft-paired": int(AddressPairingSoft),
+	"arbitrary":   int(AddressPairingNone),
+}
+
+func (a AddressPairing) String() string {
+	return addressPairingNames.Name("AddressPairing", int(a))
+}
+
+func (a AddressPairing) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *AddressPairing) UnmarshalText(bs []byte) error {
+	v, err := addressPairingNames.Parse("address pairing", bs)
+	if err != nil {
+		return err
+	}
+	*a = AddressPairing(v)
+	return nil
+}
+
+var portAllocationNames = enum.Names{
+	"random":                     int(PortAllocationRandom),
+	"sequential":                 int(PortAllocationSequential),
+	"delta":                      int(PortAllocationDelta),
+	"per-destination-sequential": int(PortAllocationPerDestination),
+}
+
+func (a PortAllocation) String() string {
+	return portAllocationNames.Name("PortAllocation", int(a))
+}
+
+func (a PortAllocation) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *PortAllocation) UnmarshalText(bs []byte) error {
+	v, err := portAllocationNames.Parse("port allocation", bs)
+	if err != nil {
+		return err
+	}
+	*a = PortAllocation(v)
+	return nil
+}
@@ -4,47 +4,171 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"strconv"
+	"sync"
 )
 
 type PortMatching int
 type AddressPairing int
+type PortAllocation int
 
 const (
 	// Prefer WAN port matching client source port, but pick another
 	// if not possible.
 	PortMatchingSoft PortMatching = iota
 	// WAN port must match client source port, even if this stomps on
-	// an existing mapping.
+	// an existing mapping. The existing mapping is evicted, see
+	// SetEvictHandler.
 	PortMatchingHard
 	// Client source port has no influence over WAN port.
 	PortMatchingNone
+)
 
+const (
 	// All the mappings for a client IP must be on the same WAN
 	// IP. New allocations fail if no ports are available on the
 	// selected WAN IP.
 	AddressPairingHard AddressPairing = iota
+	// All the mappings for a client IP should be on the same WAN
+	// IP. If no ports are available on the selected WAN IP, other
+	// WAN IPs are tried.
+	AddressPairingSoft
 	// Client IP has no influence over the selected WAN IP.
 	AddressPairingNone
 )
 
+const (
+	// Pick a random WAN port.
+	PortAllocationRandom PortAllocation = iota
+	// Hand out WAN ports in increasing order, skipping ports that
+	// are in use.
+	PortAllocationSequential
+	// Hand out WAN ports in steps of PortAllocationDelta, skipping
+	// ports that are in use.
+	PortAllocationDelta
+	// Like PortAllocationSequential, but with a separate sequence for
+	// each remote IP.
+	PortAllocationPerDestination
+)
+
 type Config struct {
 	// WAN IPs on which to allocate ports.
 	WANIPs []net.IP
+	// WAN IPs on which allocations always fail, as if all their
+	// ports were in use.
+	ExhaustedIPs []net.IP
 
 	// How do a client's source IP and port influence the allocation
 	// of a WAN IP and port?
 	PortMatching   PortMatching
 	AddressPairing AddressPairing
+
+	// When the WAN port doesn't match the client source port, pick
+	// one with the same parity (REQ-4).
+	PortParity bool
+	// When allocating a WAN port x' for an even client port x, also
+	// try to set aside x'+1 for the client's port x+1. This emulates
+	// NATs that keep RTP/RTCP port pairs contiguous. Only applies to
+	// UDP and TCP.
+	PortContiguity bool
+
+	// Reserve UDP and TCP ports by binding real sockets to them,
+	// rather than only keeping track of them in memory. This
+	// requires WANIPs to be assigned to local interfaces, but keeps
+	// other processes from using the ports, and makes the ports
+	// visible as in use to the kernel.
+	ParkSockets bool
+
+	// Ports that may be allocated on WAN IPs that don't have an
+	// entry in IPPortRanges. The zero value allows all ports, but
+	// only picks ports from 1024-65535 when they're not dictated by
+	// PortMatching.
+	PortRange PortRange
+	// Ports that may be allocated on specific WAN IPs, keyed by
+	// ip.String().
+	IPPortRanges map[string]PortRange
+	// Ports that are never allocated on any WAN IP.
+	ExcludedPorts []PortRange
+	// PortRange, IPPortRanges and ExcludedPorts only restrict UDP and
+	// TCP ports. ICMP identifiers are always allocated from 1-65535.
+
+	// Seed for all the random choices of the PortManager. Given the
+	// same seed and the same sequence of calls, a PortManager makes
+	// the same allocations, except where parked sockets collide with
+	// other processes. Use RandomSeed to get different allocations on
+	// every run.
+	Seed int64
+
+	// How are WAN ports picked, when they're not dictated by
+	// PortMatching?
+	PortAllocation PortAllocation
+	// First WAN port handed out by the non-random PortAllocation
+	// strategies. Zero, or a port outside the IP's allowed range,
+	// means the first port of the range. Sequences wrap around
+	// within the allowed range.
+	PortAllocationStart int
+	// Step between consecutive WAN ports with PortAllocationDelta. May
+	// be negative, must not be zero.
+	PortAllocationDelta int
 }
 
-// A PortManager allocates WAN ip:ports on demand.
+// A PortManager allocates WAN ip:ports on demand. It is safe for
+// concurrent use.
 type PortManager struct {
+	mu     sync.Mutex
 	config *Config
 	rng    *rand.Rand
-	// ip.String() -> allocated net.Conn
-	allocated map[string]net.Conn
+	// network+" "+ip:port -> current allocation of the port
+	allocated map[string]*allocation
+	// ip.String() -> true if the IP is artificially exhausted.
+	exhausted map[string]bool
+	// network+" "+clientIP:clientPort -> WAN port set aside for that
+	// client port by PortContiguity.
+	reserved map[string]*reservation
+	// network+" "+ip:port -> reservation of the WAN port, the same
+	// entries as reserved keyed the other way around.
+	reservedPorts map[string]*reservation
+	// network+" "+ip -> ports in use or not allowed.
+	ports map[string]*portSet
+	// sequenceKey -> next port in the sequence, for the non-random
+	// PortAllocation strategies.
+	next map[string]int
+	// evicted, if set, is called when PortMatchingHard takes a port
+	// away from an existing allocation.
+	evicted func(network string, ip net.IP, port int)
+	// evictions are the ports taken away by the Allocate call in
+	// progress, to pass to evicted once p is unlocked.
+	evictions []eviction
+}
+
+// eviction is a WAN port taken away from its previous owner.
+type eviction struct {
+	network string
+	ip      net.IP
+	port    int
+}
+
+// allocation is an allocated WAN ip:port.
+type allocation struct {
+	// conn releases the port.
+	conn io.Closer
+	// reserved is the port that was set aside alongside this one by
+	// PortContiguity, if any.
+	reserved *reservation
+}
+
+// reservation is a WAN port set aside for a specific client port.
+type reservation struct {
+	// key and portKey are the reservation's keys in
+	// PortManager.reserved and PortManager.reservedPorts.
+	key     string
+	portKey string
+	ip      net.IP
+	port    int
+	conn    io.Closer
 }
 
 // ipRefcount holds an IP address and a reference count.
@@ -54,85 +178,479 @@ type ipRefcount struct {
 }
 
 func New(config *Config) *PortManager {
-	return &PortManager{
-		config:    config,
-		rng:       NewRandom(),
-		allocated: map[string]net.Conn{},
+	ret := &PortManager{
+		config:        config,
+		rng:           NewRandom(config.Seed),
+		allocated:     map[string]*allocation{},
+		reserved:      map[string]*reservation{},
+		reservedPorts: map[string]*reservation{},
+		exhausted:     map[string]bool{},
+		next:          map[string]int{},
+		ports:         map[string]*portSet{},
+	}
+	for _, ip := range config.ExhaustedIPs {
+		ret.exhausted[ip.String()] = true
 	}
+	return ret
 }
 
-// Allocate tries to allocate a WAN ip:port for the given clientAddr.
-func (p *PortManager) AllocateUDP(clientAddr *net.UDPAddr) (port *net.UDPAddr, close func(), err error) {
-	conn, err := p.allocate(clientAddr)
+// SetEvictHandler sets a function to call when PortMatchingHard
+// hands a port that is already allocated to a new client. The
+// previous owner of the port must stop using it. The old allocation's
+// close function becomes a no-op, and the port it had set aside for
+// PortContiguity, if any, is released.
+//
+// The handler runs synchronously inside the Allocate call that
+// caused the eviction, after the PortManager is unlocked. It must be
+// set before the first allocation.
+func (p *PortManager) SetEvictHandler(fn func(network string, ip net.IP, port int)) {
+	p.evicted = fn
+}
+
+// SetExhausted sets whether ip is artificially exhausted. Allocations
+// on an exhausted IP fail as if all its ports were in use, which is
+// handy to exercise the fallback behavior of AddressPairingSoft.
+// Existing allocations are unaffected.
+func (p *PortManager) SetExhausted(ip net.IP, exhausted bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if exhausted {
+		p.exhausted[ip.String()] = true
+	} else {
+		delete(p.exhausted, ip.String())
+	}
+}
+
+// Allocate tries to allocate a WAN ip:port for the given clientAddr,
+// which is talking to remoteAddr.
+func (p *PortManager) AllocateUDP(clientAddr, remoteAddr *net.UDPAddr) (port *net.UDPAddr, close func(), err error) {
+	ip, allocated, close, err := p.allocate("udp4", clientAddr.IP, clientAddr.Port, remoteAddr.IP)
 	if err != nil {
 		return nil, nil, err
 	}
+	return &net.UDPAddr{IP: ip, Port: allocated}, close, nil
+}
 
-	addr := conn.LocalAddr().(*net.UDPAddr)
-	close = func() { p.deleteConn(addr.String()) }
+// AllocateTCP tries to allocate a WAN ip:port for the given
+// clientAddr, which is talking to remoteAddr.
+func (p *PortManager) AllocateTCP(clientAddr, remoteAddr *net.TCPAddr) (port *net.TCPAddr, close func(), err error) {
+	ip, allocated, close, err := p.allocate("tcp4", clientAddr.IP, clientAddr.Port, remoteAddr.IP)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: allocated}, close, nil
+}
+
+// AllocateICMP tries to allocate a WAN IP and ICMP query identifier
+// for the given client IP and identifier, which is pinging
+// remoteIP. Identifiers are allocated like ports, according to the
+// policies in Config.
+func (p *PortManager) AllocateICMP(clientIP net.IP, clientID int, remoteIP net.IP) (ip net.IP, id int, close func(), err error) {
+	return p.allocate("icmp4", clientIP, clientID, remoteIP)
+}
 
-	p.allocated[addr.String()] = conn
+// release frees the allocation a of key, unless the port has since
+// been handed to someone else.
+func (p *PortManager) release(key string, a *allocation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	return addr, close, nil
+	if p.allocated[key] != a {
+		return
+	}
+	delete(p.allocated, key)
+	a.conn.Close()
+	p.releaseReservation(a.reserved)
+}
+
+// releaseReservation frees r, unless it was already claimed or
+// released. r may be nil.
+func (p *PortManager) releaseReservation(r *reservation) {
+	if r == nil || p.reserved[r.key] != r {
+		return
+	}
+	p.unreserve(r)
+	r.conn.Close()
 }
 
-func (p *PortManager) deleteConn(addr string) {
-	conn := p.allocated[addr]
-	delete(p.allocated, addr)
-	conn.Close()
+// unreserve removes r from the reservations, without releasing its
+// port.
+func (p *PortManager) unreserve(r *reservation) {
+	delete(p.reserved, r.key)
+	delete(p.reservedPorts, r.portKey)
 }
 
-func (p *PortManager) allocate(clientAddr *net.UDPAddr) (net.Conn, error) {
+func (p *PortManager) allocate(network string, clientIP net.IP, clientPort int, remoteIP net.IP) (ip net.IP, port int, close func(), err error) {
+	p.mu.Lock()
+	ip, port, close, err = p.allocateLocked(network, clientIP, clientPort, remoteIP)
+	evictions := p.evictions
+	p.evictions = nil
+	p.mu.Unlock()
+
+	if p.evicted != nil {
+		for _, e := range evictions {
+			p.evicted(e.network, e.ip, e.port)
+		}
+	}
+	return ip, port, close, err
+}
+
+func (p *PortManager) allocateLocked(network string, clientIP net.IP, clientPort int, remoteIP net.IP) (ip net.IP, port int, close func(), err error) {
+	var conn io.Closer
+	if r := p.reserved[allocationKey(network, clientIP, clientPort)]; r != nil {
+		p.unreserve(r)
+		ip, port, conn = r.ip, r.port, r.conn
+	} else {
+		ip, port, conn, err = p.allocateIP(network, clientIP, clientPort, remoteIP)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+	}
+
+	key := allocationKey(network, ip, port)
+	a := &allocation{conn: conn}
+	if p.config.PortContiguity && network != "icmp4" && clientPort%2 == 0 {
+		a.reserved = p.reserveNext(network, clientIP, clientPort, ip, port)
+	}
+	close = func() { p.release(key, a) }
+	p.allocated[key] = a
+
+	return ip, port, close, nil
+}
+
+// reserveNext tries to park port+1 on ip, and sets it aside for the
+// client's clientPort+1. It returns nil if port+1 is unavailable.
+func (p *PortManager) reserveNext(network string, clientIP net.IP, clientPort int, ip net.IP, port int) *reservation {
+	key := allocationKey(network, clientIP, clientPort+1)
+	if port == 65535 || p.reserved[key] != nil || p.allocated[allocationKey(network, ip, port+1)] != nil {
+		return nil
+	}
+	_, conn, err := p.park(network, ip, port+1)
+	if err != nil {
+		return nil
+	}
+	r := &reservation{
+		key:     key,
+		portKey: allocationKey(network, ip, port+1),
+		ip:      ip,
+		port:    port + 1,
+		conn:    conn,
+	}
+	p.reserved[r.key] = r
+	p.reservedPorts[r.portKey] = r
+	return r
+}
+
+func (p *PortManager) allocateIP(network string, clientIP net.IP, clientPort int, remoteIP net.IP) (net.IP, int, io.Closer, error) {
 	switch p.config.AddressPairing {
 	case AddressPairingNone:
 		for attempts := 0; attempts < 256; attempts++ {
 			ip := p.config.WANIPs[p.rng.Intn(len(p.config.WANIPs))]
-			conn, err := p.allocatePort(clientAddr.Port, ip)
+			port, conn, err := p.allocateOnIP(network, clientPort, ip, remoteIP)
 			if err == nil {
 				// TODO: be more discriminating, "address in use" is the
 				// error that's continuable.
-				return conn, nil
+				return ip, port, conn, nil
 			}
 		}
-		return nil, fmt.Errorf("no available WAN ports")
+		return nil, 0, nil, fmt.Errorf("no available WAN ports")
 
 	case AddressPairingHard:
-		// Deterministically pick one IP in the available pool. It's
-		// not uniform.
-		sum := sha256.Sum256([]byte(clientAddr.IP))
-		h := int(binary.BigEndian.Uint32(sum[:4]))
-		publicIP := p.config.WANIPs[h%len(p.config.WANIPs)]
 		// We're only allowed to allocate from the deterministic IP,
 		// so if port selection fails, we fail as well.
-		return p.allocatePort(clientAddr.Port, publicIP)
+		publicIP := p.config.WANIPs[p.pairedIP(clientIP)]
+		port, conn, err := p.allocateOnIP(network, clientPort, publicIP, remoteIP)
+		return publicIP, port, conn, err
+
+	case AddressPairingSoft:
+		// Start with the deterministic IP, and walk the rest of the
+		// pool in order if it has no available ports.
+		first := p.pairedIP(clientIP)
+		var err error
+		for i := range p.config.WANIPs {
+			ip := p.config.WANIPs[(first+i)%len(p.config.WANIPs)]
+			var (
+				port int
+				conn io.Closer
+			)
+			port, conn, err = p.allocateOnIP(network, clientPort, ip, remoteIP)
+			if err == nil {
+				return ip, port, conn, nil
+			}
+		}
+		return nil, 0, nil, fmt.Errorf("no available WAN ports on any IP, last error: %s", err)
 
 	default:
 		panic("unimplemented case")
 	}
 }
 
+// pairedIP returns the index in WANIPs of the IP that clientIP is
+// paired with.
+func (p *PortManager) pairedIP(clientIP net.IP) int {
+	// Deterministically pick one IP in the available pool. It's not
+	// uniform.
+	sum := sha256.Sum256([]byte(clientIP))
+	h := int(binary.BigEndian.Uint32(sum[:4]) & 0x7fffffff)
+	return h % len(p.config.WANIPs)
+}
+
+// allocateOnIP tries to allocate a port on ip, unless ip is
+// artificially exhausted.
+func (p *PortManager) allocateOnIP(network string, clientPort int, ip, remoteIP net.IP) (int, io.Closer, error) {
+	if p.exhausted[ip.String()] {
+		return 0, nil, fmt.Errorf("no available ports on %s (artificially exhausted)", ip)
+	}
+	return p.allocatePort(network, clientPort, ip, remoteIP)
+}
+
 // allocatePort tries to allocate a port on the given IP, according to
 // the port policy in Config.
-func (p *PortManager) allocatePort(clientPort int, ip net.IP) (net.Conn, error) {
+func (p *PortManager) allocatePort(network string, clientPort int, ip, remoteIP net.IP) (int, io.Closer, error) {
 	switch p.config.PortMatching {
 	case PortMatchingNone:
-		return net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: 0})
+		return p.pickPort(network, clientPort, ip, remoteIP)
 
 	case PortMatchingSoft:
-		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: clientPort})
+		port, conn, err := p.park(network, ip, clientPort)
 		if err != nil {
-			return net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: 0})
+			return p.pickPort(network, clientPort, ip, remoteIP)
 		}
-		return conn, nil
+		return port, conn, nil
 
 	case PortMatchingHard:
-		wantedAddr := &net.UDPAddr{IP: ip, Port: clientPort}
-		if conn := p.allocated[wantedAddr.String()]; conn != nil {
-			return conn, nil
+		key := allocationKey(network, ip, clientPort)
+		if a := p.allocated[key]; a != nil {
+			// Port overloading: the new client takes over the parked
+			// port, and its previous owner gets evicted.
+			delete(p.allocated, key)
+			p.releaseReservation(a.reserved)
+			p.evictions = append(p.evictions, eviction{network, ip, clientPort})
+			return clientPort, a.conn, nil
+		}
+		if r := p.reservedPorts[key]; r != nil {
+			// The port was set aside for another client by
+			// PortContiguity. Nobody uses it yet, so there's nobody
+			// to evict.
+			p.unreserve(r)
+			return clientPort, r.conn, nil
+		}
+		return p.park(network, ip, clientPort)
+
+	default:
+		panic("unimplemented case")
+	}
+}
+
+// pickPort parks some port on ip, according to PortAllocation and
+// PortParity.
+func (p *PortManager) pickPort(network string, clientPort int, ip, remoteIP net.IP) (int, io.Closer, error) {
+	if p.config.PortAllocation == PortAllocationRandom {
+		return p.pickRandomPort(network, clientPort, ip)
+	}
+
+	r := p.pickRange(network, ip)
+	key := p.sequenceKey(network, ip, remoteIP)
+	port, ok := p.next[key]
+	if !ok {
+		port = p.firstPort(r)
+	}
+	delta := p.delta()
+	for attempts := 0; attempts <= int(r.Last-r.First); attempts++ {
+		if p.config.PortParity && port&1 != clientPort&1 {
+			port = step(r, port, sign(delta))
+		}
+		if parked, conn, err := p.park(network, ip, port); err == nil {
+			p.next[key] = step(r, parked, delta)
+			return parked, conn, nil
 		}
-		return net.ListenUDP("udp4", wantedAddr)
+		port = step(r, port, delta)
+	}
+	return 0, nil, fmt.Errorf("no available %s ports on %s", network, ip)
+}
+
+// pickRandomPort parks a random port on ip, subject to PortParity.
+func (p *PortManager) pickRandomPort(network string, clientPort int, ip net.IP) (int, io.Closer, error) {
+	if !p.config.PortParity {
+		return p.park(network, ip, 0)
+	}
+	r := p.pickRange(network, ip)
+	for attempts := 0; attempts < 256; attempts++ {
+		port := int(r.First) + p.rng.Intn(int(r.Last-r.First)+1)
+		if port&1 != clientPort&1 {
+			port = step(r, port, 1)
+		}
+		if port, conn, err := p.park(network, ip, port); err == nil {
+			return port, conn, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("no available %s ports on %s with the parity of %d", network, ip, clientPort)
+}
+
+// sequenceKey returns the key in p.next of the port sequence that
+// allocations on ip towards remoteIP draw from.
+func (p *PortManager) sequenceKey(network string, ip, remoteIP net.IP) string {
+	if p.config.PortAllocation == PortAllocationPerDestination {
+		return network + " " + ip.String() + " " + remoteIP.String()
+	}
+	return network + " " + ip.String()
+}
 
+// firstPort returns the port that sequences in r start at.
+func (p *PortManager) firstPort(r PortRange) int {
+	start := p.config.PortAllocationStart
+	if start == 0 || start > 65535 || !r.Contains(uint16(start)) {
+		return int(r.First)
+	}
+	return start
+}
+
+// delta returns the step between consecutive ports of a sequence.
+func (p *PortManager) delta() int {
+	if p.config.PortAllocation == PortAllocationDelta {
+		return p.config.PortAllocationDelta
+	}
+	return 1
+}
+
+// step returns port+delta, wrapped around to stay within r.
+func step(r PortRange, port, delta int) int {
+	first, n := int(r.First), int(r.Last-r.First)+1
+	off := (port - first + delta) % n
+	if off < 0 {
+		off += n
+	}
+	return first + off
+}
+
+func sign(n int) int {
+	if n < 0 {
+		return -1
+	}
+	return 1
+}
+
+// icmpRange is the range of ICMP identifiers, which aren't subject to
+// the configured port ranges.
+var icmpRange = PortRange{1, 65535}
+
+// allowedRange returns the configured range of network ports that may
+// be allocated on ip.
+func (p *PortManager) allowedRange(network string, ip net.IP) PortRange {
+	if network == "icmp4" {
+		return icmpRange
+	}
+	if r, ok := p.config.IPPortRanges[ip.String()]; ok {
+		return r
+	}
+	if p.config.PortRange == (PortRange{}) {
+		return PortRange{1, 65535}
+	}
+	return p.config.PortRange
+}
+
+// pickRange returns the range in which network ports are picked on
+// ip, when they're not dictated by PortMatching.
+func (p *PortManager) pickRange(network string, ip net.IP) PortRange {
+	if network == "icmp4" {
+		return icmpRange
+	}
+	if _, ok := p.config.IPPortRanges[ip.String()]; !ok && p.config.PortRange == (PortRange{}) {
+		return PortRange{1024, 65535}
+	}
+	return p.allowedRange(network, ip)
+}
+
+// allowed reports whether network port may be allocated on ip.
+func (p *PortManager) allowed(network string, ip net.IP, port int) bool {
+	if port == 0 || !p.allowedRange(network, ip).Contains(uint16(port)) {
+		return false
+	}
+	if network == "icmp4" {
+		return true
+	}
+	for _, r := range p.config.ExcludedPorts {
+		if r.Contains(uint16(port)) {
+			return false
+		}
+	}
+	return true
+}
+
+// unavailablePorts returns the set of ports on ip that are
+// unavailable for network, because they're in use or not allowed.
+func (p *PortManager) unavailablePorts(network string, ip net.IP) *portSet {
+	key := network + " " + ip.String()
+	if set := p.ports[key]; set != nil {
+		return set
+	}
+	set := &portSet{}
+	for port := 0; port < 65536; port++ {
+		if !p.allowed(network, ip, port) {
+			set.add(port)
+		}
+	}
+	p.ports[key] = set
+	return set
+}
+
+// park reserves ip:port on network, and returns the reserved
+// port. If port is 0, a random free port is picked.
+func (p *PortManager) park(network string, ip net.IP, port int) (int, io.Closer, error) {
+	set := p.unavailablePorts(network, ip)
+	if port != 0 {
+		if !p.allowed(network, ip, port) {
+			return 0, nil, fmt.Errorf("%s port %d is not allowed on %s", network, port, ip)
+		}
+		if set.has(port) {
+			return 0, nil, fmt.Errorf("%s port %d already in use on %s", network, port, ip)
+		}
+		return p.parkPort(set, network, ip, port)
+	}
+
+	r := p.pickRange(network, ip)
+	for attempts := 0; attempts < 256; attempts++ {
+		port = set.free(r, int(r.First)+p.rng.Intn(int(r.Last-r.First)+1))
+		if port == 0 {
+			break
+		}
+		if port, conn, err := p.parkPort(set, network, ip, port); err == nil {
+			return port, conn, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("no available %s ports on %s", network, ip)
+}
+
+// parkPort marks port as in use in set, and parks a socket on it if
+// configured to.
+func (p *PortManager) parkPort(set *portSet, network string, ip net.IP, port int) (int, io.Closer, error) {
+	ret := parkedPort{set: set, port: port}
+	// The kernel has no ICMP identifiers for us to park, so those
+	// are only ever tracked in memory.
+	if p.config.ParkSockets && network != "icmp4" {
+		conn, err := listen(network, ip, port)
+		if err != nil {
+			return 0, nil, err
+		}
+		ret.conn = conn
+	}
+	set.add(port)
+	return port, ret, nil
+}
+
+// listen parks a socket on ip:port on network.
+func listen(network string, ip net.IP, port int) (io.Closer, error) {
+	switch network {
+	case "udp4":
+		return net.ListenUDP(network, &net.UDPAddr{IP: ip, Port: port})
+	case "tcp4":
+		return net.ListenTCP(network, &net.TCPAddr{IP: ip, Port: port})
 	default:
 		panic("unimplemented case")
 	}
 }
+
+func allocationKey(network string, ip net.IP, port int) string {
+	return network + " " + net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
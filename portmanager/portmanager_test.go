@@ -0,0 +1,587 @@
+package portmanager
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+var (
+	testWANIP1 = net.IPv4(203, 0, 113, 1).To4()
+	testWANIP2 = net.IPv4(203, 0, 113, 2).To4()
+	testClient = net.IPv4(192, 168, 1, 10).To4()
+	testRemote = net.IPv4(198, 51, 100, 7).To4()
+)
+
+// newTestManager returns a PortManager for config, which only tracks
+// ports in memory. WANIPs defaults to testWANIP1.
+func newTestManager(config Config) *PortManager {
+	if config.WANIPs == nil {
+		config.WANIPs = []net.IP{testWANIP1}
+	}
+	return New(&config)
+}
+
+// allocUDP allocates a WAN port for testClient:clientPort talking to
+// remoteIP.
+func allocUDP(p *PortManager, clientPort int, remoteIP net.IP) (*net.UDPAddr, func(), error) {
+	return p.AllocateUDP(&net.UDPAddr{IP: testClient, Port: clientPort}, &net.UDPAddr{IP: remoteIP, Port: 3478})
+}
+
+// allocPorts allocates n WAN ports for consecutive client ports
+// starting at 5000, and returns the ports. The test fails if any
+// allocation does.
+func allocPorts(t *testing.T, p *PortManager, n int) []int {
+	t.Helper()
+	var ret []int
+	for i := 0; i < n; i++ {
+		a, _, err := allocUDP(p, 5000+i, testRemote)
+		if err != nil {
+			t.Fatalf("allocation %d failed: %s", i, err)
+		}
+		ret = append(ret, a.Port)
+	}
+	return ret
+}
+
+func equalPorts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStep(t *testing.T) {
+	tests := []struct {
+		r     PortRange
+		port  int
+		delta int
+		want  int
+	}{
+		{PortRange{1000, 1004}, 1000, 1, 1001},
+		{PortRange{1000, 1004}, 1004, 1, 1000},
+		{PortRange{1000, 1004}, 1003, 2, 1000},
+		{PortRange{1000, 1004}, 1000, -1, 1004},
+		{PortRange{1000, 1004}, 1001, -2, 1004},
+		{PortRange{1000, 1004}, 1000, 7, 1002},
+		{PortRange{1000, 1004}, 1000, -7, 1003},
+		{PortRange{1000, 1004}, 1002, 5, 1002},
+		{PortRange{1000, 1000}, 1000, -3, 1000},
+		{PortRange{1, 65535}, 65535, 1, 1},
+		{PortRange{1, 65535}, 1, -1, 65535},
+	}
+	for _, test := range tests {
+		if got := step(test.r, test.port, test.delta); got != test.want {
+			t.Errorf("step(%s, %d, %d) = %d, want %d", test.r, test.port, test.delta, got, test.want)
+		}
+	}
+}
+
+func TestPortSetFree(t *testing.T) {
+	var s portSet
+	r := PortRange{60, 200}
+	if got := s.free(r, 100); got != 100 {
+		t.Errorf("free from 100 in empty set = %d, want 100", got)
+	}
+	// Fill 64-127, a whole bitmap word, plus the ports on either side
+	// of it.
+	for port := 63; port <= 128; port++ {
+		s.add(port)
+	}
+	if got := s.free(r, 63); got != 129 {
+		t.Errorf("free from 63 = %d, want 129", got)
+	}
+	// Fill the rest of the range after the word, so the scan has to
+	// wrap around to r.First.
+	for port := 129; port <= 200; port++ {
+		s.add(port)
+	}
+	if got := s.free(r, 100); got != 60 {
+		t.Errorf("free from 100 with the top of the range full = %d, want 60", got)
+	}
+	for port := 60; port < 63; port++ {
+		s.add(port)
+	}
+	if got := s.free(r, 100); got != 0 {
+		t.Errorf("free in full range = %d, want 0", got)
+	}
+	s.remove(200)
+	if got := s.free(r, 60); got != 200 {
+		t.Errorf("free from 60 with only the last port free = %d, want 200", got)
+	}
+}
+
+func TestSequenceAllocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   []int
+	}{
+		{
+			name: "sequential",
+			config: Config{
+				PortAllocation: PortAllocationSequential,
+				PortRange:      PortRange{1000, 1004},
+			},
+			want: []int{1000, 1001, 1002, 1003, 1004},
+		},
+		{
+			name: "sequential wraparound",
+			config: Config{
+				PortAllocation:      PortAllocationSequential,
+				PortAllocationStart: 1003,
+				PortRange:           PortRange{1000, 1004},
+			},
+			want: []int{1003, 1004, 1000, 1001, 1002},
+		},
+		{
+			name: "start outside range",
+			config: Config{
+				PortAllocation:      PortAllocationSequential,
+				PortAllocationStart: 999,
+				PortRange:           PortRange{1000, 1002},
+			},
+			want: []int{1000, 1001, 1002},
+		},
+		{
+			name: "delta wraparound",
+			config: Config{
+				PortAllocation:      PortAllocationDelta,
+				PortAllocationDelta: 2,
+				PortRange:           PortRange{1000, 1004},
+			},
+			want: []int{1000, 1002, 1004, 1001, 1003},
+		},
+		{
+			name: "negative delta",
+			config: Config{
+				PortAllocation:      PortAllocationDelta,
+				PortAllocationDelta: -1,
+				PortAllocationStart: 1002,
+				PortRange:           PortRange{1000, 1004},
+			},
+			want: []int{1002, 1001, 1000, 1004, 1003},
+		},
+		{
+			name: "negative delta wraparound",
+			config: Config{
+				PortAllocation:      PortAllocationDelta,
+				PortAllocationDelta: -2,
+				PortRange:           PortRange{1000, 1004},
+			},
+			want: []int{1000, 1003, 1001, 1004, 1002},
+		},
+		{
+			name: "delta larger than range",
+			config: Config{
+				PortAllocation:      PortAllocationDelta,
+				PortAllocationDelta: 7,
+				PortRange:           PortRange{1000, 1004},
+			},
+			want: []int{1000, 1002, 1004, 1001, 1003},
+		},
+		{
+			name: "sequential skips exclusions",
+			config: Config{
+				PortAllocation: PortAllocationSequential,
+				PortRange:      PortRange{1000, 1006},
+				ExcludedPorts:  []PortRange{{1000, 1000}, {1002, 1003}, {1006, 1006}},
+			},
+			want: []int{1001, 1004, 1005},
+		},
+		{
+			name: "sequential parity",
+			config: Config{
+				PortAllocation: PortAllocationSequential,
+				PortParity:     true,
+				PortRange:      PortRange{1001, 1006},
+			},
+			// Client ports alternate between even and odd, starting
+			// with 5000, so 1001 is skipped.
+			want: []int{1002, 1003, 1004, 1005, 1006},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.PortMatching = PortMatchingNone
+			p := newTestManager(test.config)
+			got := allocPorts(t, p, len(test.want))
+			if !equalPorts(got, test.want) {
+				t.Fatalf("allocated %v, want %v", got, test.want)
+			}
+			if a, _, err := allocUDP(p, 6000, testRemote); err == nil {
+				t.Fatalf("allocated %s in an exhausted range", a)
+			}
+		})
+	}
+}
+
+func TestSequenceReusesReleasedPorts(t *testing.T) {
+	p := newTestManager(Config{
+		PortMatching:   PortMatchingNone,
+		PortAllocation: PortAllocationSequential,
+		PortRange:      PortRange{1000, 1002},
+	})
+	var closes []func()
+	for i := 0; i < 3; i++ {
+		_, close, err := allocUDP(p, 5000+i, testRemote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		closes = append(closes, close)
+	}
+	closes[1]()
+	a, _, err := allocUDP(p, 6000, testRemote)
+	if err != nil {
+		t.Fatalf("allocation after release failed: %s", err)
+	}
+	if a.Port != 1001 {
+		t.Fatalf("allocated %d after releasing 1001, want 1001", a.Port)
+	}
+}
+
+func TestPerDestinationSequential(t *testing.T) {
+	p := newTestManager(Config{
+		PortMatching:   PortMatchingNone,
+		PortAllocation: PortAllocationPerDestination,
+		PortRange:      PortRange{1000, 1009},
+	})
+	remote2 := net.IPv4(198, 51, 100, 8).To4()
+	var got []int
+	for i, remote := range []net.IP{testRemote, testRemote, remote2, testRemote, remote2} {
+		a, _, err := allocUDP(p, 5000+i, remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, a.Port)
+	}
+	// Each remote has its own sequence, which skips the ports taken
+	// by the other.
+	want := []int{1000, 1001, 1002, 1003, 1004}
+	if !equalPorts(got, want) {
+		t.Fatalf("allocated %v, want %v", got, want)
+	}
+
+	p = newTestManager(Config{
+		PortMatching:        PortMatchingNone,
+		PortAllocation:      PortAllocationPerDestination,
+		PortAllocationStart: 1005,
+		PortRange:           PortRange{1000, 1009},
+	})
+	got = nil
+	for i, remote := range []net.IP{testRemote, remote2, remote2, testRemote} {
+		a, _, err := allocUDP(p, 5000+i, remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, a.Port)
+	}
+	want = []int{1005, 1006, 1007, 1008}
+	if !equalPorts(got, want) {
+		t.Fatalf("allocated %v with a start port, want %v", got, want)
+	}
+}
+
+func TestRandomParity(t *testing.T) {
+	p := newTestManager(Config{
+		PortMatching: PortMatchingNone,
+		PortParity:   true,
+		PortRange:    PortRange{1000, 1999},
+	})
+	for i := 0; i < 200; i++ {
+		clientPort := 5000 + i
+		a, _, err := allocUDP(p, clientPort, testRemote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Port%2 != clientPort%2 {
+			t.Fatalf("client port %d got WAN port %d, with a different parity", clientPort, a.Port)
+		}
+		if a.Port < 1000 || a.Port > 1999 {
+			t.Fatalf("client port %d got WAN port %d, outside the allowed range", clientPort, a.Port)
+		}
+	}
+}
+
+func TestPortContiguity(t *testing.T) {
+	p := newTestManager(Config{
+		PortMatching:   PortMatchingNone,
+		PortAllocation: PortAllocationSequential,
+		PortContiguity: true,
+		PortRange:      PortRange{1000, 1009},
+	})
+	alloc := func(clientPort int) int {
+		t.Helper()
+		a, _, err := allocUDP(p, clientPort, testRemote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a.Port
+	}
+
+	if got := alloc(5000); got != 1000 {
+		t.Fatalf("client port 5000 got %d, want 1000", got)
+	}
+	// 1001 is set aside for client port 5001, so other clients skip
+	// it.
+	if got := alloc(6000); got != 1002 {
+		t.Fatalf("client port 6000 got %d, want 1002", got)
+	}
+	if got := alloc(5001); got != 1001 {
+		t.Fatalf("client port 5001 got %d, want the contiguous 1001", got)
+	}
+	if got := alloc(6001); got != 1003 {
+		t.Fatalf("client port 6001 got %d, want the contiguous 1003", got)
+	}
+	// Odd client ports don't set anything aside.
+	if got := alloc(7001); got != 1004 {
+		t.Fatalf("client port 7001 got %d, want 1004", got)
+	}
+	if got := alloc(8000); got != 1005 {
+		t.Fatalf("client port 8000 got %d, want 1005", got)
+	}
+}
+
+func TestPortContiguityRelease(t *testing.T) {
+	p := newTestManager(Config{
+		PortMatching:   PortMatchingNone,
+		PortAllocation: PortAllocationSequential,
+		PortContiguity: true,
+		PortRange:      PortRange{1000, 1001},
+	})
+	_, close, err := allocUDP(p, 5000, testRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _, err := allocUDP(p, 6000, testRemote); err == nil {
+		t.Fatalf("allocated reserved port %s to another client", a)
+	}
+	// Releasing the port also releases the one set aside with it.
+	close()
+	for _, clientPort := range []int{6000, 7000} {
+		if _, _, err := allocUDP(p, clientPort, testRemote); err != nil {
+			t.Fatalf("allocation for client port %d failed after release: %s", clientPort, err)
+		}
+	}
+}
+
+func TestPortOverloadingContiguity(t *testing.T) {
+	p := newTestManager(Config{
+		PortMatching:   PortMatchingHard,
+		PortContiguity: true,
+	})
+	var evicted []int
+	p.SetEvictHandler(func(network string, ip net.IP, port int) {
+		evicted = append(evicted, port)
+	})
+	client := func(last byte) net.IP {
+		return net.IPv4(192, 168, 1, last).To4()
+	}
+	alloc := func(clientIP net.IP, clientPort int) {
+		t.Helper()
+		a, _, err := p.AllocateUDP(&net.UDPAddr{IP: clientIP, Port: clientPort}, &net.UDPAddr{IP: testRemote, Port: 3478})
+		if err != nil {
+			t.Fatalf("allocation for %s:%d failed: %s", clientIP, clientPort, err)
+		}
+		if a.Port != clientPort {
+			t.Fatalf("allocation for %s:%d got port %d, want %d", clientIP, clientPort, a.Port, clientPort)
+		}
+	}
+	reserved := func(clientIP net.IP, clientPort int) bool {
+		return p.reserved[allocationKey("udp4", clientIP, clientPort)] != nil
+	}
+
+	// .10:5000 sets 5001 aside for .10:5001, and .11:5001 takes it
+	// over. Nothing was using it, so nothing is evicted.
+	alloc(client(10), 5000)
+	alloc(client(11), 5001)
+	if reserved(client(10), 5001) {
+		t.Error("port 5001 still set aside for 192.168.1.10:5001 after .11 took it over")
+	}
+	if len(evicted) != 0 {
+		t.Errorf("taking over a reserved port evicted %v, want nothing", evicted)
+	}
+
+	// .12:6000 sets 6001 aside, and loses 6000 to .13:6000. The port
+	// set aside goes to the new owner.
+	alloc(client(12), 6000)
+	alloc(client(13), 6000)
+	if len(evicted) != 1 || evicted[0] != 6000 {
+		t.Errorf("got evictions %v, want [6000]", evicted)
+	}
+	if reserved(client(12), 6001) {
+		t.Error("port 6001 still set aside for the evicted 192.168.1.12:6000")
+	}
+	if !reserved(client(13), 6001) {
+		t.Error("port 6001 not set aside for the new owner of 6000")
+	}
+	if len(p.reserved) != len(p.reservedPorts) {
+		t.Errorf("%d reservations by client port, but %d by WAN port", len(p.reserved), len(p.reservedPorts))
+	}
+}
+
+func TestPortRanges(t *testing.T) {
+	p := newTestManager(Config{
+		WANIPs:        []net.IP{testWANIP1, testWANIP2},
+		PortMatching:  PortMatchingSoft,
+		PortRange:     PortRange{1000, 1010},
+		IPPortRanges:  map[string]PortRange{testWANIP2.String(): {2000, 2001}},
+		ExcludedPorts: []PortRange{{1000, 1000}, {1005, 1006}, {1010, 1010}, {2001, 2001}},
+	})
+	tests := []struct {
+		ip         net.IP
+		clientPort int
+		preserved  bool
+	}{
+		// The edges of the range and of the exclusions.
+		{testWANIP1, 999, false},
+		{testWANIP1, 1000, false},
+		{testWANIP1, 1001, true},
+		{testWANIP1, 1004, true},
+		{testWANIP1, 1005, false},
+		{testWANIP1, 1006, false},
+		{testWANIP1, 1007, true},
+		{testWANIP1, 1009, true},
+		{testWANIP1, 1010, false},
+		{testWANIP1, 1011, false},
+		// The IP's own range replaces the global one, but the
+		// exclusions still apply.
+		{testWANIP2, 1001, false},
+		{testWANIP2, 2000, true},
+		{testWANIP2, 2001, false},
+	}
+	for _, test := range tests {
+		port, close, err := p.allocatePort("udp4", test.clientPort, test.ip, testRemote)
+		if err != nil {
+			t.Errorf("%s: allocating for client port %d failed: %s", test.ip, test.clientPort, err)
+			continue
+		}
+		if got := port == test.clientPort; got != test.preserved {
+			t.Errorf("%s: client port %d got WAN port %d, want preserved=%v", test.ip, test.clientPort, port, test.preserved)
+		}
+		if !p.allowed("udp4", test.ip, port) {
+			t.Errorf("%s: client port %d got disallowed WAN port %d", test.ip, test.clientPort, port)
+		}
+		close.Close()
+	}
+}
+
+func TestDefaultPortRange(t *testing.T) {
+	p := newTestManager(Config{PortMatching: PortMatchingSoft})
+	// Preserved ports may be anything, but picked ones are never
+	// below 1024.
+	if a, _, err := allocUDP(p, 80, testRemote); err != nil || a.Port != 80 {
+		t.Fatalf("got %v, %v for client port 80, want 80", a, err)
+	}
+	for i := 0; i < 100; i++ {
+		a, _, err := allocUDP(p, 80, testRemote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Port < 1024 {
+			t.Fatalf("picked WAN port %d, want 1024-65535", a.Port)
+		}
+	}
+}
+
+func TestRandomExhaustsRange(t *testing.T) {
+	p := newTestManager(Config{
+		PortMatching: PortMatchingNone,
+		PortRange:    PortRange{1000, 1003},
+	})
+	seen := map[int]bool{}
+	for _, port := range allocPorts(t, p, 4) {
+		if port < 1000 || port > 1003 || seen[port] {
+			t.Fatalf("allocated %d, want an unused port in 1000-1003", port)
+		}
+		seen[port] = true
+	}
+	if a, _, err := allocUDP(p, 6000, testRemote); err == nil {
+		t.Fatalf("allocated %s in an exhausted range", a)
+	}
+}
+
+func TestICMPIgnoresPortRanges(t *testing.T) {
+	p := newTestManager(Config{
+		PortMatching:  PortMatchingSoft,
+		PortRange:     PortRange{1000, 1001},
+		ExcludedPorts: []PortRange{{1, 999}},
+	})
+	for _, id := range []int{1, 5, 1000, 65535} {
+		_, got, _, err := p.AllocateICMP(testClient, id, testRemote)
+		if err != nil {
+			t.Fatalf("allocating ICMP identifier %d failed: %s", id, err)
+		}
+		if got != id {
+			t.Errorf("ICMP identifier %d mapped to %d, want it preserved", id, got)
+		}
+	}
+
+	p = newTestManager(Config{
+		PortMatching: PortMatchingNone,
+		PortRange:    PortRange{1000, 1001},
+	})
+	for i := 0; i < 10; i++ {
+		if _, _, _, err := p.AllocateICMP(testClient, 1, testRemote); err != nil {
+			t.Fatalf("allocating ICMP identifier %d failed: %s", i, err)
+		}
+	}
+}
+
+func TestExhaustedIPs(t *testing.T) {
+	wanIPs := []net.IP{testWANIP1, testWANIP2}
+	pm := newTestManager(Config{WANIPs: wanIPs})
+	paired := wanIPs[pm.pairedIP(testClient)]
+	other := wanIPs[1-pm.pairedIP(testClient)]
+
+	tests := []struct {
+		pairing AddressPairing
+		// want is the WAN IP of the allocation, or nil if it must
+		// fail.
+		want net.IP
+	}{
+		{AddressPairingHard, nil},
+		{AddressPairingSoft, other},
+		{AddressPairingNone, other},
+	}
+	for _, test := range tests {
+		t.Run(test.pairing.String(), func(t *testing.T) {
+			p := newTestManager(Config{
+				WANIPs:         wanIPs,
+				ExhaustedIPs:   []net.IP{paired},
+				AddressPairing: test.pairing,
+				PortMatching:   PortMatchingSoft,
+			})
+			for i := 0; i < 20; i++ {
+				a, _, err := allocUDP(p, 5000+i, testRemote)
+				switch {
+				case test.want == nil && err == nil:
+					t.Fatalf("allocated %s on exhausted IP", a)
+				case test.want == nil:
+					if !strings.Contains(err.Error(), "exhausted") {
+						t.Fatalf("allocation failed with %q, want it to blame the exhausted IP", err)
+					}
+				case err != nil:
+					t.Fatalf("allocation failed: %s", err)
+				case !a.IP.Equal(test.want):
+					t.Fatalf("allocated %s, want an address on %s", a, test.want)
+				}
+			}
+
+			p.SetExhausted(paired, false)
+			a, _, err := allocUDP(p, 6000, testRemote)
+			if err != nil {
+				t.Fatalf("allocation failed after un-exhausting %s: %s", paired, err)
+			}
+			if test.pairing != AddressPairingNone && !a.IP.Equal(paired) {
+				t.Fatalf("allocated %s after un-exhausting, want an address on %s", a, paired)
+			}
+		})
+	}
+}
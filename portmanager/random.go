@@ -6,10 +6,17 @@ import (
 	"math/rand"
 )
 
-func NewRandom() *rand.Rand {
+// NewRandom returns a deterministic source of randomness seeded with
+// seed.
+func NewRandom(seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed))
+}
+
+// RandomSeed returns a seed for NewRandom, read from crypto/rand.
+func RandomSeed() int64 {
 	var buf [8]byte
 	if _, err := crand.Read(buf[:]); err != nil {
 		panic("ran out of entropy")
 	}
-	return rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(buf[:]))))
+	return int64(binary.BigEndian.Uint64(buf[:]))
 }
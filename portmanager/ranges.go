@@ -0,0 +1,48 @@
+package portmanager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First, Last uint16
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(int(r.First))
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.First && port <= r.Last
+}
+
+func (r PortRange) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses a port range of the form "53" or "1000-2000".
+func (r *PortRange) UnmarshalText(bs []byte) error {
+	fs := strings.SplitN(string(bs), "-", 2)
+	first, err := strconv.ParseUint(fs[0], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port range %q: %s", string(bs), err)
+	}
+	last := first
+	if len(fs) == 2 {
+		last, err = strconv.ParseUint(fs[1], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port range %q: %s", string(bs), err)
+		}
+	}
+	if last < first {
+		return fmt.Errorf("invalid port range %q: last port is lower than first port", string(bs))
+	}
+	r.First, r.Last = uint16(first), uint16(last)
+	return nil
+}
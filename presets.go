@@ -0,0 +1,141 @@
+package main
+
+import (
+	"time"
+
+	"go.universe.tf/natlab/internal/enum"
+	"go.universe.tf/natlab/portmanager"
+)
+
+// presets are named NAT profiles modeled on common devices. Each one
+// is applied on top of the flag defaults, and can itself be
+// overridden by a config file and by flags.
+var presets = map[string]func(p *Profile){
+	// What RFC 4787 and RFC 5382 recommend: endpoint-independent
+	// mapping and filtering, paired pooling, port and parity
+	// preservation, full hairpinning and generous timeouts. The
+	// easiest NAT to traverse.
+	"rfc-ideal": func(p *Profile) {
+		p.Mapping = MappingEndpointIndependent
+		p.Filtering = FilteringEndpointIndependent
+		p.Hairpinning = HairpinExternalSource
+		p.AddressPooling = portmanager.AddressPairingHard
+		p.PortAssignment = portmanager.PortMatchingSoft
+		p.PortParity = true
+		p.PortAllocation = portmanager.PortAllocationRandom
+		p.MappingTimeout.Duration = 5 * time.Minute
+		p.TCPEstablishedTimeout.Duration = 124 * time.Minute
+		p.TCPTransitoryTimeout.Duration = 4 * time.Minute
+		p.Refresh = RefreshBoth
+		p.ICMP = true
+	},
+
+	// A Linux box doing iptables MASQUERADE with stock conntrack
+	// settings. Source ports are preserved when free, and only
+	// replies from the exact remote endpoint get back in. Nothing
+	// hairpins without extra rules. UDP mappings only get conntrack's
+	// short unreplied timeout, but TCP connections live for days.
+	"linux-masquerade": func(p *Profile) {
+		p.Mapping = MappingEndpointIndependent
+		p.Filtering = FilteringAddressAndPortDependent
+		p.Hairpinning = HairpinNone
+		p.AddressPooling = portmanager.AddressPairingHard
+		p.PortAssignment = portmanager.PortMatchingSoft
+		p.PortAllocation = portmanager.PortAllocationRandom
+		p.MappingTimeout.Duration = 30 * time.Second
+		p.TCPEstablishedTimeout.Duration = 5 * 24 * time.Hour
+		p.TCPTransitoryTimeout.Duration = 2 * time.Minute
+		p.ICMPTimeout.Duration = 30 * time.Second
+		p.Refresh = RefreshBoth
+		p.ICMP = true
+	},
+
+	// An enterprise firewall: a fresh, sequentially allocated
+	// mapping for every destination, strict filtering, an arbitrary
+	// WAN IP from the pool for each mapping, no hairpinning and short
+	// timeouts that only outbound traffic refreshes. The classic
+	// symmetric NAT, which defeats most hole punching.
+	"symmetric-enterprise": func(p *Profile) {
+		p.Mapping = MappingAddressAndPortDependent
+		p.Filtering = FilteringAddressAndPortDependent
+		p.Hairpinning = HairpinNone
+		p.AddressPooling = portmanager.AddressPairingNone
+		p.PortAssignment = portmanager.PortMatchingNone
+		p.PortAllocation = portmanager.PortAllocationSequential
+		p.MappingTimeout.Duration = 60 * time.Second
+		p.TCPEstablishedTimeout.Duration = 60 * time.Minute
+		p.TCPTransitoryTimeout.Duration = 1 * time.Minute
+		p.Refresh = RefreshOutbound
+		p.ICMP = true
+	},
+
+	// A permissive home router: once a LAN host has sent a packet
+	// out, anyone can reach it through the mapping. Ports are
+	// preserved when possible, and the small NAT table quietly drops
+	// its least recently used mappings when full.
+	"full-cone-home": func(p *Profile) {
+		p.Mapping = MappingEndpointIndependent
+		p.Filtering = FilteringEndpointIndependent
+		p.Hairpinning = HairpinExternalSource
+		p.AddressPooling = portmanager.AddressPairingHard
+		p.PortAssignment = portmanager.PortMatchingSoft
+		p.PortAllocation = portmanager.PortAllocationRandom
+		p.MappingTimeout.Duration = 2 * time.Minute
+		p.Refresh = RefreshBoth
+		p.ICMP = true
+		p.MaxMappings = 4096
+		p.TableOverflow = OverflowEvictLRU
+	},
+
+	// The most common consumer router: endpoint-independent mapping,
+	// but only replies from endpoints the LAN host has sent to get
+	// back in. No hairpinning, and only outbound traffic keeps
+	// mappings alive.
+	"port-restricted-cone": func(p *Profile) {
+		p.Mapping = MappingEndpointIndependent
+		p.Filtering = FilteringAddressAndPortDependent
+		p.Hairpinning = HairpinNone
+		p.AddressPooling = portmanager.AddressPairingHard
+		p.PortAssignment = portmanager.PortMatchingSoft
+		p.PortAllocation = portmanager.PortAllocationRandom
+		p.MappingTimeout.Duration = 2 * time.Minute
+		p.Refresh = RefreshOutbound
+		p.ICMP = true
+	},
+
+	// A carrier-grade NAT following RFC 6888: endpoint-independent
+	// mapping, paired pooling and hairpinning, but random ports, no
+	// well-known ports and a per-subscriber port quota that drops new
+	// flows once exhausted.
+	"cgnat": func(p *Profile) {
+		p.Mapping = MappingEndpointIndependent
+		p.Filtering = FilteringAddressAndPortDependent
+		p.Hairpinning = HairpinExternalSource
+		p.AddressPooling = portmanager.AddressPairingHard
+		p.PortAssignment = portmanager.PortMatchingNone
+		p.PortAllocation = portmanager.PortAllocationRandom
+		p.PortRanges = []WANPortRange{{Ports: portmanager.PortRange{First: 1024, Last: 65535}}}
+		p.MappingTimeout.Duration = 2 * time.Minute
+		p.TCPEstablishedTimeout.Duration = 124 * time.Minute
+		p.TCPTransitoryTimeout.Duration = 4 * time.Minute
+		p.Refresh = RefreshOutbound
+		p.ICMP = true
+		p.HostQuota = 1024
+		p.QuotaOverflow = OverflowDrop
+	},
+}
+
+// applyPreset overlays the preset called name onto p.
+func (p *Profile) applyPreset(name string) error {
+	preset, ok := presets[name]
+	if !ok {
+		var valid []string
+		for name := range presets {
+			valid = append(valid, name)
+		}
+		return enum.UnknownValue("preset", name, valid)
+	}
+	preset(p)
+	p.Preset = name
+	return nil
+}
@@ -23,7 +23,7 @@ type MappingProbe struct {
 }
 
 func (p MappingProbe) key() string {
-	return fmt.Sprintf("%s %s %s %s", p.Local, p.Mapped, p.Remote, p.Timeout)
+	return fmt.Sprintf("%s %s %s %t", p.Local, p.Mapped, p.Remote, p.Timeout)
 }
 
 // FirewallProbe is the outcome of a firewall state probe.
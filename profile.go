@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.universe.tf/natlab/portmanager"
+)
+
+// Profile is the complete configuration of the nat command. It can
+// be loaded from a JSON file with --config, and every field can be
+// overridden by the command-line flag of the same name.
+type Profile struct {
+	// Name of the preset the profile starts from, if any.
+	Preset string `json:"preset,omitempty"`
+
+	LANInterface string `json:"lan-interface,omitempty"`
+	WANInterface string `json:"wan-interface,omitempty"`
+	Queue        int    `json:"queue"`
+	Queues       int    `json:"queues"`
+	// Addresses of the control API and of the Prometheus metrics,
+	// if any.
+	Control string `json:"control,omitempty"`
+	Metrics string `json:"metrics,omitempty"`
+
+	// Mapping, filtering and hairpinning (REQ-1, REQ-8, REQ-9).
+	Mapping     MappingBehavior   `json:"mapping"`
+	Filtering   FilteringBehavior `json:"filtering"`
+	Hairpinning HairpinBehavior   `json:"hairpinning"`
+
+	// WAN address pooling and port assignment (REQ-2, REQ-3, REQ-4).
+	AddressPooling      portmanager.AddressPairing `json:"address-pooling"`
+	PortAssignment      portmanager.PortMatching   `json:"port-assignment"`
+	PortParity          bool                       `json:"port-parity"`
+	PortContiguity      bool                       `json:"port-contiguity"`
+	ParkSockets         bool                       `json:"park-sockets"`
+	PortAllocation      portmanager.PortAllocation `json:"port-allocation"`
+	PortAllocationStart int                        `json:"port-allocation-start,omitempty"`
+	PortAllocationDelta int                        `json:"port-allocation-delta"`
+	PortRanges          []WANPortRange             `json:"port-range,omitempty"`
+	ExcludePorts        []portmanager.PortRange    `json:"exclude-ports,omitempty"`
+	ExhaustIPs          []net.IP                   `json:"exhaust-ip,omitempty"`
+	// Nil means a fresh random seed on every run.
+	Seed *int64 `json:"seed,omitempty"`
+
+	// Timeouts and refresh (REQ-5, REQ-6).
+	MappingTimeout        Duration        `json:"mapping-timeout"`
+	PortTimeouts          []PortTimeout   `json:"port-timeout,omitempty"`
+	TCPEstablishedTimeout Duration        `json:"tcp-established-timeout"`
+	TCPTransitoryTimeout  Duration        `json:"tcp-transitory-timeout"`
+	ICMPTimeout           Duration        `json:"icmp-timeout"`
+	ReapInterval          Duration        `json:"reap-interval"`
+	Refresh               RefreshBehavior `json:"refresh"`
+
+	// ICMP (REQ-12) and deliberate brokenness.
+	ICMP          bool `json:"icmp"`
+	ZeroChecksums bool `json:"zero-checksums"`
+
+	// Limits.
+	HostQuota     int              `json:"host-quota,omitempty"`
+	QuotaOverflow OverflowBehavior `json:"quota-overflow"`
+	MaxMappings   int              `json:"max-mappings,omitempty"`
+	TableOverflow OverflowBehavior `json:"table-overflow"`
+}
+
+// loadProfile assembles the nat command's profile from the flag
+// defaults, the preset if any, the --config file if any, and the
+// flags set on the command line, in increasing order of precedence,
+// and validates the result.
+func loadProfile(c *cli.Context) (*Profile, error) {
+	p := &Profile{}
+	if err := p.applyFlags(c, false); err != nil {
+		return nil, err
+	}
+
+	var file []byte
+	path := c.String("config")
+	if path != "" {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file = bs
+	}
+
+	// The preset goes underneath the rest of the config file, so it
+	// has to be picked out before the file is loaded.
+	var preset struct {
+		Preset string `json:"preset"`
+	}
+	if file != nil {
+		if err := json.Unmarshal(file, &preset); err != nil {
+			return nil, decodeError(path, file, err)
+		}
+	}
+	if c.IsSet("preset") {
+		preset.Preset = c.String("preset")
+	}
+	if preset.Preset != "" {
+		if err := p.applyPreset(preset.Preset); err != nil {
+			return nil, err
+		}
+	}
+
+	if file != nil {
+		if err := p.load(path, file); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.applyFlags(c, true); err != nil {
+		return nil, err
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// load overlays the settings in bs, the JSON contents of the file at
+// path, onto p.
+func (p *Profile) load(path string, bs []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return decodeError(path, bs, err)
+	}
+	if dec.More() {
+		return fmt.Errorf("%s: unexpected data after the profile object", path)
+	}
+	return nil
+}
+
+// decodeError returns err, from decoding bs, the JSON contents of the
+// file at path, annotated with the line it happened on if known.
+func decodeError(path string, bs []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	line := 1 + bytes.Count(bs[:offset], []byte("\n"))
+	return fmt.Errorf("%s:%d: %s", path, line, err)
+}
+
+// applyFlags copies the nat command's flags into p. If onlySet is
+// true, only the flags given on the command line are copied,
+// otherwise all of them are, with their defaults if unset.
+//
+// List flags replace the corresponding list from the config file,
+// rather than adding to it.
+func (p *Profile) applyFlags(c *cli.Context, onlySet bool) error {
+	set := func(name string) bool {
+		return !onlySet || c.IsSet(name)
+	}
+	var err error
+	text := func(name string, v encoding.TextUnmarshaler) {
+		if err != nil || !set(name) {
+			return
+		}
+		if e := v.UnmarshalText([]byte(c.String(name))); e != nil {
+			err = fmt.Errorf("parsing --%s: %s", name, e)
+		}
+	}
+	// texts replaces a list with the values of the list flag name,
+	// after clearing it with reset.
+	texts := func(name string, reset func(), parse func([]byte) error) {
+		if err != nil || !set(name) {
+			return
+		}
+		reset()
+		for _, s := range c.StringSlice(name) {
+			if e := parse([]byte(s)); e != nil {
+				err = fmt.Errorf("parsing --%s: %s", name, e)
+				return
+			}
+		}
+	}
+
+	if set("preset") {
+		p.Preset = c.String("preset")
+	}
+	if set("lan-interface") {
+		p.LANInterface = c.String("lan-interface")
+	}
+	if set("wan-interface") {
+		p.WANInterface = c.String("wan-interface")
+	}
+	if set("queue") {
+		p.Queue = c.Int("queue")
+	}
+	if set("queues") {
+		p.Queues = c.Int("queues")
+	}
+	if set("control") {
+		p.Control = c.String("control")
+	}
+	if set("metrics") {
+		p.Metrics = c.String("metrics")
+	}
+
+	text("mapping", &p.Mapping)
+	text("filtering", &p.Filtering)
+	text("hairpinning", &p.Hairpinning)
+
+	text("address-pooling", &p.AddressPooling)
+	text("port-assignment", &p.PortAssignment)
+	if set("port-parity") {
+		p.PortParity = c.Bool("port-parity")
+	}
+	if set("port-contiguity") {
+		p.PortContiguity = c.Bool("port-contiguity")
+	}
+	if set("park-sockets") {
+		p.ParkSockets = c.Bool("park-sockets")
+	}
+	text("port-allocation", &p.PortAllocation)
+	if set("port-allocation-start") {
+		p.PortAllocationStart = c.Int("port-allocation-start")
+	}
+	if set("port-allocation-delta") {
+		p.PortAllocationDelta = c.Int("port-allocation-delta")
+	}
+	texts("port-range", func() { p.PortRanges = nil }, func(bs []byte) error {
+		var r WANPortRange
+		if err := r.UnmarshalText(bs); err != nil {
+			return err
+		}
+		p.PortRanges = append(p.PortRanges, r)
+		return nil
+	})
+	texts("exclude-ports", func() { p.ExcludePorts = nil }, func(bs []byte) error {
+		var r portmanager.PortRange
+		if err := r.UnmarshalText(bs); err != nil {
+			return err
+		}
+		p.ExcludePorts = append(p.ExcludePorts, r)
+		return nil
+	})
+	texts("exhaust-ip", func() { p.ExhaustIPs = nil }, func(bs []byte) error {
+		var ip net.IP
+		if err := ip.UnmarshalText(bs); err != nil {
+			return err
+		}
+		p.ExhaustIPs = append(p.ExhaustIPs, ip)
+		return nil
+	})
+	// The seed has no default, so it's only ever copied when set.
+	if c.IsSet("seed") {
+		seed := c.Int64("seed")
+		p.Seed = &seed
+	}
+
+	if set("mapping-timeout") {
+		p.MappingTimeout.Duration = c.Duration("mapping-timeout")
+	}
+	texts("port-timeout", func() { p.PortTimeouts = nil }, func(bs []byte) error {
+		var t PortTimeout
+		if err := t.UnmarshalText(bs); err != nil {
+			return err
+		}
+		p.PortTimeouts = append(p.PortTimeouts, t)
+		return nil
+	})
+	if set("tcp-established-timeout") {
+		p.TCPEstablishedTimeout.Duration = c.Duration("tcp-established-timeout")
+	}
+	if set("tcp-transitory-timeout") {
+		p.TCPTransitoryTimeout.Duration = c.Duration("tcp-transitory-timeout")
+	}
+	if set("icmp-timeout") {
+		p.ICMPTimeout.Duration = c.Duration("icmp-timeout")
+	}
+	if set("reap-interval") {
+		p.ReapInterval.Duration = c.Duration("reap-interval")
+	}
+	text("refresh", &p.Refresh)
+
+	if set("icmp") {
+		p.ICMP = c.Bool("icmp")
+	}
+	if set("zero-checksums") {
+		p.ZeroChecksums = c.Bool("zero-checksums")
+	}
+
+	if set("host-quota") {
+		p.HostQuota = c.Int("host-quota")
+	}
+	text("quota-overflow", &p.QuotaOverflow)
+	if set("max-mappings") {
+		p.MaxMappings = c.Int("max-mappings")
+	}
+	text("table-overflow", &p.TableOverflow)
+
+	return err
+}
+
+// Validate checks that p describes a NAT that can be run.
+func (p *Profile) Validate() error {
+	if p.LANInterface == "" {
+		return errors.New("lan-interface must be set")
+	}
+	if p.WANInterface == "" {
+		return errors.New("wan-interface must be set")
+	}
+	if p.Queues < 1 {
+		return fmt.Errorf("queues must be positive, got %d", p.Queues)
+	}
+	if p.Queue < 0 || p.Queue+p.Queues > 65536 {
+		return fmt.Errorf("queue and queues must describe NFQUEUE numbers in 0-65535, got %d-%d", p.Queue, p.Queue+p.Queues-1)
+	}
+	if p.Control != "" {
+		if _, err := controlListenAddr(p.Control); err != nil {
+			return fmt.Errorf("control %s: %s", p.Control, err)
+		}
+	}
+
+	if p.PortAllocationStart < 0 || p.PortAllocationStart > 65535 {
+		return fmt.Errorf("port-allocation-start must be a port number, got %d", p.PortAllocationStart)
+	}
+	if p.PortAllocationDelta == 0 || p.PortAllocationDelta < -65535 || p.PortAllocationDelta > 65535 {
+		return fmt.Errorf("port-allocation-delta must be a nonzero port offset, got %d", p.PortAllocationDelta)
+	}
+	rangeIPs := map[string]bool{}
+	for _, r := range p.PortRanges {
+		if r.IP != nil && r.IP.To4() == nil {
+			return fmt.Errorf("port-range %s: %s is not an IPv4 address", r, r.IP)
+		}
+		if r.Ports.First == 0 {
+			return fmt.Errorf("port-range %s: port 0 cannot be allocated", r)
+		}
+		// An empty key stands for the range that applies to all WAN
+		// IPs.
+		k := ""
+		if r.IP != nil {
+			k = r.IP.String()
+		}
+		if rangeIPs[k] {
+			if k == "" {
+				return fmt.Errorf("port-range %s: only one port range may apply to all WAN IPs", r)
+			}
+			return fmt.Errorf("port-range %s: only one port range may apply to %s", r, k)
+		}
+		rangeIPs[k] = true
+	}
+	for _, ip := range p.ExhaustIPs {
+		if ip.To4() == nil {
+			return fmt.Errorf("exhaust-ip %s is not an IPv4 address", ip)
+		}
+	}
+
+	for _, d := range []struct {
+		name string
+		d    Duration
+	}{
+		{"mapping-timeout", p.MappingTimeout},
+		{"tcp-established-timeout", p.TCPEstablishedTimeout},
+		{"tcp-transitory-timeout", p.TCPTransitoryTimeout},
+		{"icmp-timeout", p.ICMPTimeout},
+		{"reap-interval", p.ReapInterval},
+	} {
+		if d.d.Duration <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", d.name, d.d)
+		}
+	}
+	for _, t := range p.PortTimeouts {
+		if t.Timeout <= 0 {
+			return fmt.Errorf("port-timeout %s: timeout must be positive", t)
+		}
+	}
+
+	if p.HostQuota < 0 {
+		return fmt.Errorf("host-quota must not be negative, got %d", p.HostQuota)
+	}
+	if p.MaxMappings < 0 {
+		return fmt.Errorf("max-mappings must not be negative, got %d", p.MaxMappings)
+	}
+	return nil
+}
+
+// TranslatorConfig returns the translator settings of p.
+func (p *Profile) TranslatorConfig() *TranslatorConfig {
+	return &TranslatorConfig{
+		Mapping:               p.Mapping,
+		Filtering:             p.Filtering,
+		Hairpinning:           p.Hairpinning,
+		MappingTimeout:        p.MappingTimeout.Duration,
+		PortTimeouts:          p.PortTimeouts,
+		TCPEstablishedTimeout: p.TCPEstablishedTimeout.Duration,
+		TCPTransitoryTimeout:  p.TCPTransitoryTimeout.Duration,
+		ICMPTimeout:           p.ICMPTimeout.Duration,
+		Refresh:               p.Refresh,
+		TranslateICMP:         p.ICMP,
+		ZeroChecksums:         p.ZeroChecksums,
+		HostQuota:             p.HostQuota,
+		QuotaOverflow:         p.QuotaOverflow,
+		MaxMappings:           p.MaxMappings,
+		TableOverflow:         p.TableOverflow,
+	}
+}
+
+// PortConfig returns the port manager settings of p, for a NAT with
+// the given WAN IPs. A nil p.Seed yields a fresh random seed.
+func (p *Profile) PortConfig(wanIPs []net.IP) *portmanager.Config {
+	ret := &portmanager.Config{
+		WANIPs:              wanIPs,
+		ExhaustedIPs:        p.ExhaustIPs,
+		PortMatching:        p.PortAssignment,
+		AddressPairing:      p.AddressPooling,
+		PortParity:          p.PortParity,
+		PortContiguity:      p.PortContiguity,
+		ParkSockets:         p.ParkSockets,
+		ExcludedPorts:       p.ExcludePorts,
+		PortAllocation:      p.PortAllocation,
+		PortAllocationStart: p.PortAllocationStart,
+		PortAllocationDelta: p.PortAllocationDelta,
+	}
+	for _, r := range p.PortRanges {
+		if r.IP == nil {
+			ret.PortRange = r.Ports
+			continue
+		}
+		if ret.IPPortRanges == nil {
+			ret.IPPortRanges = map[string]portmanager.PortRange{}
+		}
+		ret.IPPortRanges[r.IP.String()] = r.Ports
+	}
+	if p.Seed != nil {
+		ret.Seed = *p.Seed
+	} else {
+		ret.Seed = portmanager.RandomSeed()
+	}
+	return ret
+}
+
+// Duration is a time.Duration that reads and writes as a string
+// like "2m30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(bs []byte) error {
+	v, err := time.ParseDuration(string(bs))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// WANPortRange restricts the WAN ports that can be allocated on one
+// WAN IP, or on all of them if IP is nil.
+type WANPortRange struct {
+	IP    net.IP
+	Ports portmanager.PortRange
+}
+
+func (r WANPortRange) String() string {
+	if r.IP == nil {
+		return r.Ports.String()
+	}
+	return fmt.Sprintf("%s=%s", r.IP, r.Ports)
+}
+
+func (r WANPortRange) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses a WAN port range of the form "1024-65535" or
+// "192.0.2.1=20000-29999".
+func (r *WANPortRange) UnmarshalText(bs []byte) error {
+	fs := strings.SplitN(string(bs), "=", 2)
+	if len(fs) == 2 {
+		r.IP = net.ParseIP(fs[0])
+		if r.IP == nil {
+			return fmt.Errorf("invalid WAN port range %q: %q is not an IP address", string(bs), fs[0])
+		}
+	} else {
+		r.IP = nil
+	}
+	return r.Ports.UnmarshalText([]byte(fs[len(fs)-1]))
+}
@@ -0,0 +1,63 @@
+package main
+
+// tcpConn tracks the state of one TCP connection through a mapping,
+// as far as the NAT can tell from the flags it sees go by (RFC 5382).
+type tcpConn struct {
+	synOut, synIn bool
+	finOut, finIn bool
+	rst           bool
+}
+
+// update advances the connection's state with a packet's TCP flags.
+func (c *tcpConn) update(flags byte, outbound bool) {
+	if flags&tcpFlagRST != 0 {
+		c.rst = true
+		return
+	}
+	if flags&tcpFlagSYN != 0 {
+		if c.rst || (c.finOut && c.finIn) {
+			// New connection reusing the 4-tuple of a dead one.
+			*c = tcpConn{}
+		}
+		if outbound {
+			c.synOut = true
+		} else {
+			c.synIn = true
+		}
+	}
+	if flags&tcpFlagFIN != 0 {
+		if outbound {
+			c.finOut = true
+		} else {
+			c.finIn = true
+		}
+	}
+}
+
+// established reports whether both ends have sent a SYN, and neither
+// has started closing the connection. Note that this covers both the
+// regular 3-way handshake and TCP simultaneous open.
+func (c *tcpConn) established() bool {
+	return c.synOut && c.synIn && !c.finOut && !c.finIn && !c.rst
+}
+
+// trackTCP updates the state of e's TCP connection with remote.
+func (e *ctEntry) trackTCP(remote Addr, flags byte, outbound bool) {
+	c := e.TCP[remote]
+	if c == nil {
+		c = &tcpConn{}
+		e.TCP[remote] = c
+	}
+	c.update(flags, outbound)
+}
+
+// tcpEstablished reports whether any of e's TCP connections is
+// established.
+func (e *ctEntry) tcpEstablished() bool {
+	for _, c := range e.TCP {
+		if c.established() {
+			return true
+		}
+	}
+	return false
+}
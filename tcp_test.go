@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// buildTCP returns a TCP packet from src to dst with the given flags,
+// with correct checksums.
+func buildTCP(src, dst Addr, flags byte) []byte {
+	bs := buildPacket(protoTCP, src, dst, nil)
+	bs[20+13] = flags
+	_, l4Sum := fullChecksums(bs)
+	binary.BigEndian.PutUint16(l4ChecksumField(bs), l4Sum)
+	return bs
+}
+
+// tcpStep is a TCP packet going through a connection.
+type tcpStep struct {
+	flags    byte
+	outbound bool
+}
+
+var (
+	synOut    = tcpStep{tcpFlagSYN, true}
+	synIn     = tcpStep{tcpFlagSYN, false}
+	synAckIn  = tcpStep{tcpFlagSYN | tcpFlagACK, false}
+	ackOut    = tcpStep{tcpFlagACK, true}
+	ackIn     = tcpStep{tcpFlagACK, false}
+	finOut    = tcpStep{tcpFlagFIN | tcpFlagACK, true}
+	finIn     = tcpStep{tcpFlagFIN | tcpFlagACK, false}
+	rstOut    = tcpStep{tcpFlagRST, true}
+	rstIn     = tcpStep{tcpFlagRST | tcpFlagACK, false}
+	handshake = []tcpStep{synOut, synAckIn, ackOut}
+)
+
+func steps(seqs ...[]tcpStep) []tcpStep {
+	var ret []tcpStep
+	for _, s := range seqs {
+		ret = append(ret, s...)
+	}
+	return ret
+}
+
+func TestTCPConnState(t *testing.T) {
+	tests := []struct {
+		name        string
+		steps       []tcpStep
+		established bool
+	}{
+		{"syn sent", []tcpStep{synOut}, false},
+		{"3-way handshake", handshake, true},
+		{"simultaneous open", []tcpStep{synOut, synIn, ackOut, ackIn}, true},
+		{"fin out", steps(handshake, []tcpStep{finOut}), false},
+		{"fin in", steps(handshake, []tcpStep{finIn}), false},
+		{"closed", steps(handshake, []tcpStep{finOut, finIn, ackOut}), false},
+		{"rst out", steps(handshake, []tcpStep{rstOut}), false},
+		{"rst in", steps(handshake, []tcpStep{rstIn}), false},
+		{"rst before handshake", []tcpStep{synOut, rstIn}, false},
+		{"syn after rst", steps(handshake, []tcpStep{rstIn}, handshake), true},
+		{"syn after close", steps(handshake, []tcpStep{finOut, finIn}, handshake), true},
+		// A SYN only starts over once both ends are done.
+		{"syn after one fin", steps(handshake, []tcpStep{finOut}, handshake), false},
+		{"ack after rst", steps(handshake, []tcpStep{rstOut, ackOut, ackIn}), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var c tcpConn
+			for _, s := range test.steps {
+				c.update(s.flags, s.outbound)
+			}
+			if got := c.established(); got != test.established {
+				t.Errorf("established() = %v, want %v (state %+v)", got, test.established, c)
+			}
+		})
+	}
+}
+
+func TestTCPMappingTimeouts(t *testing.T) {
+	const (
+		established = time.Hour
+		transitory  = 4 * time.Minute
+	)
+	remote := addr(198, 51, 100, 7, 443)
+
+	tests := []struct {
+		name  string
+		steps []tcpStep
+		want  time.Duration
+	}{
+		{"syn sent", []tcpStep{synOut}, transitory},
+		{"3-way handshake", handshake, established},
+		{"simultaneous open", []tcpStep{synOut, synIn}, established},
+		{"closing", steps(handshake, []tcpStep{finOut}), transitory},
+		{"reset", steps(handshake, []tcpStep{rstIn}), transitory},
+		{"reopened", steps(handshake, []tcpStep{rstIn}, handshake), established},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestTranslator(TranslatorConfig{
+				Filtering:             FilteringAddressAndPortDependent,
+				Refresh:               RefreshBoth,
+				TCPEstablishedTimeout: established,
+				TCPTransitoryTimeout:  transitory,
+			})
+			mapped := testLAN
+			for i, s := range test.steps {
+				var v TranslatorVerdict
+				if s.outbound {
+					bs := buildTCP(testLAN, remote, s.flags)
+					v = n.TranslateOutTCP(bs)
+					mapped = NewPacket(bs).SrcAddr()
+				} else {
+					v = n.TranslateInTCP(buildTCP(remote, mapped, s.flags))
+				}
+				if v != TranslatorVerdictMangle {
+					t.Fatalf("packet %d with flags %#02x got verdict %d, want mangle", i, s.flags, v)
+				}
+			}
+
+			ms := n.Mappings(MappingFilter{})
+			if len(ms) != 1 {
+				t.Fatalf("got %d mappings, want 1", len(ms))
+			}
+			if got := ms[0].Timeout.Duration; got != test.want {
+				t.Errorf("mapping timeout is %s, want %s", got, test.want)
+			}
+			if got, want := ms[0].Established, test.want == established; got != want {
+				t.Errorf("mapping established = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTCPOnlySYNCreatesMappings(t *testing.T) {
+	remote := addr(198, 51, 100, 7, 443)
+	tests := []struct {
+		flags byte
+		want  TranslatorVerdict
+	}{
+		{tcpFlagSYN, TranslatorVerdictMangle},
+		{tcpFlagSYN | tcpFlagACK, TranslatorVerdictDrop},
+		{tcpFlagACK, TranslatorVerdictDrop},
+		{tcpFlagFIN | tcpFlagACK, TranslatorVerdictDrop},
+		{tcpFlagRST, TranslatorVerdictDrop},
+	}
+	for _, test := range tests {
+		n := newTestTranslator(TranslatorConfig{})
+		if v := n.TranslateOutTCP(buildTCP(testLAN, remote, test.flags)); v != test.want {
+			t.Errorf("unmapped packet with flags %#02x got verdict %d, want %d", test.flags, v, test.want)
+		}
+		if test.want == TranslatorVerdictDrop {
+			if got := len(n.Mappings(MappingFilter{})); got != 0 {
+				t.Errorf("unmapped packet with flags %#02x created %d mappings", test.flags, got)
+			}
+		}
+	}
+
+	// Once a SYN created the mapping, the rest of the connection goes
+	// through.
+	n := newTestTranslator(TranslatorConfig{})
+	for _, flags := range []byte{tcpFlagSYN, tcpFlagACK, tcpFlagFIN | tcpFlagACK} {
+		if v := n.TranslateOutTCP(buildTCP(testLAN, remote, flags)); v != TranslatorVerdictMangle {
+			t.Errorf("mapped packet with flags %#02x got verdict %d, want mangle", flags, v)
+		}
+	}
+}